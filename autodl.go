@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Settings of the automatic URL detection of a group. If it's enabled, then URLs in the group's messages are
+// downloaded without the /dlp command.
+type autoDownloadSettings struct {
+	Enabled bool `json:"enabled"`
+	// Only URLs of these domains and their subdomains are downloaded. No domains are allowed if it's empty.
+	Domains []string `json:"domains"`
+}
+
+// Returns the given domain in a form which can be compared, so "https://www.X.com/" becomes "x.com".
+func normalizeDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	if _, after, found := strings.Cut(d, "://"); found {
+		d = after
+	}
+	d, _, _ = strings.Cut(d, "/")
+	return strings.TrimPrefix(d, "www.")
+}
+
+// Returns true if the given URL's domain is in the allowlist.
+func (s autoDownloadSettings) isAllowedURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := normalizeDomain(u.Hostname())
+	for _, d := range s.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the given domains to the allowlist. Already listed domains are skipped.
+func (s *autoDownloadSettings) addDomains(domains []string) {
+	for _, d := range domains {
+		d = normalizeDomain(d)
+		if d != "" && !slices.Contains(s.Domains, d) {
+			s.Domains = append(s.Domains, d)
+		}
+	}
+}
+
+// Removes the given domains from the allowlist.
+func (s *autoDownloadSettings) removeDomains(domains []string) {
+	for _, d := range domains {
+		if i := slices.Index(s.Domains, normalizeDomain(d)); i >= 0 {
+			s.Domains = slices.Delete(s.Domains, i, i+1)
+		}
+	}
+}
+
+func (s autoDownloadSettings) String() string {
+	str := "🔗 Automatic URL detection is "
+	if s.Enabled {
+		str += "on"
+	} else {
+		str += "off"
+	}
+	if len(s.Domains) == 0 {
+		return str + ", allowed domains: none"
+	}
+	return str + ", allowed domains: " + strings.Join(s.Domains, ", ")
+}
+
+// Returns the automatic URL detection settings of the given chat. It's disabled if the chat has no settings.
+func getAutoDownloadSettings(chatID int64) autoDownloadSettings {
+	settings, _, err := store.GetAutoDownloadSettings(chatID)
+	if err != nil {
+		fmt.Println("  error getting auto download settings:", err)
+	}
+	return settings
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math/big"
+	"strings"
+	"text/template"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/message/entity"
+	tghtml "github.com/gotd/td/telegram/message/html"
+	"github.com/gotd/td/telegram/message/styling"
+)
+
+// Telegram's max. caption length in UTF-16 code units.
+const captionMaxLength = 1024
+
+// Disables captions when used as the caption template.
+const captionOffStr = "off"
+
+const defaultCaptionTemplate = `<a href="{{.URL}}">{{.Title}}</a>{{if .Username}} (requested by @{{.Username}}){{end}}`
+
+// Fields available in caption templates. Templates are HTML formatted, the fields get escaped before rendering.
+type captionData struct {
+	Title      string
+	Uploader   string
+	URL        string
+	Duration   string
+	Resolution string
+	Size       string
+	Username   string
+}
+
+func newCaptionData(qEntry *DownloadQueueEntry, doc cachedDocument) captionData {
+	d := captionData{
+		Title:    doc.Title,
+		Uploader: doc.Uploader,
+		URL:      qEntry.URL,
+		Size:     humanize.BigBytes(big.NewInt(doc.Size)),
+		Username: qEntry.FromUsername,
+	}
+	if doc.Duration > 0 {
+		d.Duration = formatDuration(doc.Duration)
+	}
+	if doc.Width > 0 && doc.Height > 0 {
+		d.Resolution = fmt.Sprint(doc.Width, "x", doc.Height)
+	}
+	return d
+}
+
+func (d captionData) escaped() captionData {
+	return captionData{
+		Title:      html.EscapeString(d.Title),
+		Uploader:   html.EscapeString(d.Uploader),
+		URL:        html.EscapeString(d.URL),
+		Duration:   html.EscapeString(d.Duration),
+		Resolution: html.EscapeString(d.Resolution),
+		Size:       html.EscapeString(d.Size),
+		Username:   html.EscapeString(d.Username),
+	}
+}
+
+// Returns the caption template of the given chat, which is the default template if the chat has no template set.
+func getCaptionTemplate(chatID int64) string {
+	tmpl, found, err := store.GetCaptionTemplate(chatID)
+	if err != nil {
+		fmt.Println("  error getting caption template:", err)
+	}
+	if !found {
+		return params.CaptionTemplate
+	}
+	return tmpl
+}
+
+// Returns the text and length in UTF-16 code units of the given HTML as it will be displayed.
+func getStyledTextLength(s string) (text string, length int, err error) {
+	var eb entity.Builder
+	if err := tghtml.HTML(strings.NewReader(s), &eb, tghtml.Options{}); err != nil {
+		return "", 0, fmt.Errorf("invalid caption html: %w", err)
+	}
+	length = eb.UTF16Len()
+	text, _ = eb.Raw()
+	return text, length, nil
+}
+
+// Cuts the given text to fit in maxLength UTF-16 code units, with an ellipsis at the end.
+func truncateUTF16(s string, maxLength int) string {
+	if maxLength < 1 {
+		return ""
+	}
+	if entity.ComputeLength(s) <= maxLength {
+		return s
+	}
+	var length int
+	for i, r := range s {
+		l := 1
+		if r >= 0x10000 {
+			l = 2
+		}
+		if length+l > maxLength-1 {
+			return s[:i] + "…"
+		}
+		length += l
+	}
+	return s
+}
+
+// Returns the rendered HTML, and its displayed text and length in UTF-16 code units.
+func executeCaptionTemplate(tmpl *template.Template, data captionData) (htmlStr, text string, length int, err error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data.escaped()); err != nil {
+		return "", "", 0, fmt.Errorf("rendering caption: %w", err)
+	}
+	text, length, err = getStyledTextLength(sb.String())
+	return sb.String(), text, length, err
+}
+
+// Renders the given caption template. If the caption is too long, then the title gets shortened, so the
+// formatting entities are kept intact. If it's still too long, then the caption is sent as truncated plain text.
+// Returns nil if the template is empty.
+func renderCaption(tmplStr string, data captionData) ([]message.StyledTextOption, error) {
+	if tmplStr == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("caption").Parse(tmplStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid caption template: %w", err)
+	}
+
+	htmlStr, text, length, err := executeCaptionTemplate(tmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	if length <= captionMaxLength {
+		return []message.StyledTextOption{tghtml.String(nil, htmlStr)}, nil
+	}
+
+	// Getting the length without the title, so we know how many times the title is used in the template.
+	titleLength := entity.ComputeLength(data.Title)
+	noTitleData := data
+	noTitleData.Title = ""
+	_, _, noTitleLength, err := executeCaptionTemplate(tmpl, noTitleData)
+	if err != nil {
+		return nil, err
+	}
+	if titleLength > 0 && noTitleLength < captionMaxLength {
+		titleCount := max((length-noTitleLength)/titleLength, 1)
+		data.Title = truncateUTF16(data.Title, (captionMaxLength-noTitleLength)/titleCount)
+		shortenedHTMLStr, _, shortenedLength, err := executeCaptionTemplate(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		if shortenedLength <= captionMaxLength {
+			return []message.StyledTextOption{tghtml.String(nil, shortenedHTMLStr)}, nil
+		}
+	}
+	return []message.StyledTextOption{styling.Plain(truncateUTF16(text, captionMaxLength))}, nil
+}
+
+// Checks if the given caption template can be rendered.
+func validateCaptionTemplate(tmplStr string) error {
+	_, err := renderCaption(tmplStr, captionData{
+		Title:      "Title",
+		Uploader:   "Uploader",
+		URL:        "https://example.com/",
+		Duration:   "1:23",
+		Resolution: "1280x720",
+		Size:       "12 MB",
+		Username:   "username",
+	})
+	return err
+}
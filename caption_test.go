@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestTruncateUTF16(t *testing.T) {
+	tests := []struct {
+		s         string
+		maxLength int
+		want      string
+	}{
+		{s: "hello", maxLength: 10, want: "hello"},
+		{s: "hello", maxLength: 5, want: "hello"},
+		{s: "hello", maxLength: 4, want: "hel…"},
+		{s: "hello", maxLength: 1, want: "…"},
+		{s: "hello", maxLength: 0, want: ""},
+		{s: "", maxLength: 3, want: ""},
+		// Accented letters are one UTF-16 code unit, but two bytes.
+		{s: "ééééé", maxLength: 3, want: "éé…"},
+		// Emojis outside the BMP are two UTF-16 code units, they are not cut in half.
+		{s: "a😀b", maxLength: 4, want: "a😀b"},
+		{s: "a😀b", maxLength: 3, want: "a…"},
+		{s: "😀😀😀", maxLength: 5, want: "😀😀…"},
+	}
+	for _, tt := range tests {
+		if got := truncateUTF16(tt.s, tt.maxLength); got != tt.want {
+			t.Errorf("truncateUTF16(%q, %d) = %q, want %q", tt.s, tt.maxLength, got, tt.want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,11 +11,14 @@ import (
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	ffmpeg_go "github.com/u2takey/ffmpeg-go"
 	"golang.org/x/exp/slices"
 )
@@ -21,12 +26,57 @@ import (
 const probeTimeout = 10 * time.Second
 const maxFFmpegProbeBytes = 20 * 1024 * 1024
 
+// Telegram's max. thumbnail size is 320x320.
+const thumbnailMaxSize = 320
+const thumbnailPosRatio = 0.1
+
+// Parts are cut at keyframes, and the bitrate is not constant, so the segment length is calculated with some headroom.
+const splitSegmentTimeRatio = 0.9
+const splitMaxAttempts = 3
+
+// Leaving some headroom for the container overhead and bitrate fluctuations when compressing.
+const fitSizeRatio = 0.95
+const fitSizeMaxAudioBitrate = 128000
+const fitSizeMinAudioBitrate = 32000
+const fitSizeMinVideoBitrate = 100000
+
+// If the video bitrate is below minBitrate, then the video gets downscaled to the given max. height.
+var fitSizeHeights = []struct {
+	minBitrate int
+	height     int
+}{
+	{2500000, 1080},
+	{1500000, 720},
+	{800000, 480},
+	{400000, 360},
+	{200000, 240},
+}
+
 var compatibleVideoCodecs = []string{"h264", "vp9", "hevc"}
 var compatibleAudioCodecs = []string{"aac", "opus", "mp3"}
 
 type ffmpegProbeDataStreamsStream struct {
 	CodecName string `json:"codec_name"`
 	CodecType string `json:"codec_type"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Tags      struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	SideDataList []struct {
+		Rotation int `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// Returns the rotation of the stream in degrees, which is either set as a tag or in the display matrix side data.
+func (s ffmpegProbeDataStreamsStream) getRotation() int {
+	for _, sd := range s.SideDataList {
+		if sd.Rotation != 0 {
+			return sd.Rotation
+		}
+	}
+	r, _ := strconv.Atoi(s.Tags.Rotate)
+	return r
 }
 
 type ffmpegProbeDataFormat struct {
@@ -51,6 +101,27 @@ type Converter struct {
 	SingleAudioStreamNeeded bool
 
 	Duration float64
+	// Dimensions and rotation of the first video stream.
+	Width    int
+	Height   int
+	Rotation int
+
+	// If set, then the output gets compressed to fit in this size.
+	FitSize int64
+
+	// Audio bitrate of the audio formats in kbit/s. The format's default bitrate is used if it's 0.
+	AudioBitrate int
+
+	// If TrimEnd is set, then only this part of the input is kept, in seconds.
+	TrimStart float64
+	TrimEnd   float64
+
+	// Subtitles which get embedded or burned in, depending on SubtitleMode.
+	Subtitles    []SubtitleFile
+	SubtitleMode string
+
+	// Embedded as tags and cover art in audio files.
+	Metadata MediaMetadata
 
 	UpdateProgressPercentCallback UpdateProgressPercentCallbackFunc
 }
@@ -79,12 +150,14 @@ func (c *Converter) Probe(rr *ReReadCloser) error {
 	}
 
 	compatibleVideoCodecsCopy := compatibleVideoCodecs
-	if c.Format == "mp3" {
-		compatibleVideoCodecsCopy = []string{}
-	}
 	compatibleAudioCodecsCopy := compatibleAudioCodecs
-	if c.Format == "mp3" {
-		compatibleAudioCodecsCopy = []string{"mp3"}
+	if af, ok := audioFormats[c.Format]; ok {
+		compatibleVideoCodecsCopy = []string{}
+		compatibleAudioCodecsCopy = af.CopyCodecs
+		if c.AudioBitrate > 0 {
+			// The requested bitrate needs re-encoding.
+			compatibleAudioCodecsCopy = []string{}
+		}
 	}
 
 	gotVideoStream := false
@@ -108,7 +181,13 @@ func (c *Converter) Probe(rr *ReReadCloser) error {
 				}
 				gotVideoStream = true
 			}
-		} else if stream.CodecType == "audio" {
+
+			if c.Width == 0 {
+				c.Width = stream.Width
+				c.Height = stream.Height
+				c.Rotation = stream.getRotation()
+			}
+		} else if stream.CodecType == "audio" && !isGIFFormat(c.Format) {
 			if c.AudioCodecs != "" {
 				c.AudioCodecs += ", "
 			}
@@ -133,10 +212,32 @@ func (c *Converter) Probe(rr *ReReadCloser) error {
 		return fmt.Errorf("no video stream found in file")
 	}
 
+	if c.Format == videoNoteFormat {
+		// Video notes are cropped to a square, so they always need to be converted.
+		width, height := c.GetDisplaySize()
+		size := min(width, height, videoNoteMaxSize) / 2 * 2
+		c.Width, c.Height, c.Rotation = size, size, 0
+		c.VideoConvertNeeded = true
+	}
+	if isGIFFormat(c.Format) {
+		// Animations are downscaled to fit in the max. size, and they have no audio.
+		width, height := c.GetDisplaySize()
+		if width > gifMaxSize || height > gifMaxSize {
+			if width > height {
+				width, height = gifMaxSize, height*gifMaxSize/width
+			} else {
+				width, height = width*gifMaxSize/height, gifMaxSize
+			}
+		}
+		c.Width, c.Height, c.Rotation = width/2*2, height/2*2, 0
+		c.VideoConvertNeeded = true
+	}
+
 	return nil
 }
 
-func (c *Converter) ffmpegProgressSock() (sockFilename string, sock net.Listener, err error) {
+// Reports ffmpeg's progress with the given string, scaled to the given percent range.
+func (c *Converter) ffmpegProgressSock(progressStr string, startPercent, endPercent int) (sockFilename string, sock net.Listener, err error) {
 	sockFilename = path.Join(os.TempDir(), fmt.Sprintf("yt-dlp-telegram-bot-%d.sock", rand.Int()))
 	sock, err = net.Listen("unix", sockFilename)
 	if err != nil {
@@ -169,11 +270,12 @@ func (c *Converter) ffmpegProgressSock() (sockFilename string, sock net.Listener
 			if len(a) > 0 && len(a[len(a)-1]) > 0 {
 				data = ""
 				l, _ := strconv.Atoi(a[len(a)-1][len(a[len(a)-1])-1])
-				c.UpdateProgressPercentCallback(processStr, int(100*float64(l)/c.Duration/1000000))
+				pct := min(float64(l)/c.Duration/1000000, 1)
+				c.UpdateProgressPercentCallback(progressStr, startPercent+int(pct*float64(endPercent-startPercent)))
 			}
 
 			if strings.Contains(data, "progress=end") {
-				c.UpdateProgressPercentCallback(processStr, 100)
+				c.UpdateProgressPercentCallback(progressStr, endPercent)
 			}
 		}
 	}()
@@ -181,6 +283,214 @@ func (c *Converter) ffmpegProgressSock() (sockFilename string, sock net.Listener
 	return
 }
 
+// GetDisplaySize returns the video dimensions as they are displayed, with the rotation applied.
+func (c *Converter) GetDisplaySize() (width, height int) {
+	if (c.Rotation/90)%2 != 0 {
+		return c.Height, c.Width
+	}
+	return c.Width, c.Height
+}
+
+// GenerateThumbnail returns a JPEG thumbnail of the video file at the given path, which fits in thumbnailMaxSize.
+func (c *Converter) GenerateThumbnail(ctx context.Context, filePath string, duration float64) ([]byte, error) {
+	var buf bytes.Buffer
+	ff := ffmpeg_go.Input(filePath, ffmpeg_go.KwArgs{"ss": fmt.Sprintf("%.3f", duration*thumbnailPosRatio)}).
+		Output("pipe:1", ffmpeg_go.KwArgs{
+			"frames:v": 1,
+			"vf":       fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", thumbnailMaxSize, thumbnailMaxSize),
+			"c:v":      "mjpeg",
+			"q:v":      5,
+			"format":   "image2pipe",
+		})
+	ffCmd := ff.Compile()
+	cmd := NewCommand(ctx, ffCmd.Args[0], ffCmd.Args[1:]...)
+	cmd.Stdout = &buf
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error generating thumbnail: %w", err)
+	}
+	if buf.Len() == 0 {
+		return nil, fmt.Errorf("error generating thumbnail: no output")
+	}
+	return buf.Bytes(), nil
+}
+
+// Number of samples in voice message waveforms, the samples are 5 bits long.
+const waveformSamples = 100
+const waveformSampleRate = 4000
+
+// Collects the peaks of the 16-bit mono PCM audio written to it, so the audio doesn't have to be kept in memory.
+type waveformPeakWriter struct {
+	peaks []int
+	// Expected number of audio samples, used to find the waveform sample of an audio sample.
+	sampleCount int
+	// Number of audio samples written so far.
+	written int
+	// Set if the last write ended in the middle of an audio sample.
+	partial    byte
+	hasPartial bool
+	maxPeak    int
+}
+
+func (w *waveformPeakWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if w.hasPartial && len(b) > 0 {
+		w.addSample([]byte{w.partial, b[0]})
+		w.hasPartial = false
+		b = b[1:]
+	}
+	for ; len(b) >= 2; b = b[2:] {
+		w.addSample(b)
+	}
+	if len(b) == 1 {
+		w.partial = b[0]
+		w.hasPartial = true
+	}
+	return n, nil
+}
+
+func (w *waveformPeakWriter) addSample(b []byte) {
+	v := int(int16(binary.LittleEndian.Uint16(b)))
+	if v < 0 {
+		v = -v
+	}
+	// The duration can be a bit off, so the remaining samples go to the last peak.
+	p := min(w.written*len(w.peaks)/w.sampleCount, len(w.peaks)-1)
+	w.peaks[p] = max(w.peaks[p], v)
+	w.maxPeak = max(w.maxPeak, v)
+	w.written++
+}
+
+// GenerateWaveform returns the waveform of the audio file at the given path with the given duration in seconds,
+// which is shown by Telegram for voice messages.
+func (c *Converter) GenerateWaveform(ctx context.Context, filePath string, duration float64) ([]byte, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("error generating waveform: unknown duration")
+	}
+
+	w := &waveformPeakWriter{
+		peaks:       make([]int, waveformSamples),
+		sampleCount: max(int(duration*waveformSampleRate), 1),
+		maxPeak:     1,
+	}
+	ffCmd := ffmpeg_go.Input(filePath).Output("pipe:1", ffmpeg_go.KwArgs{
+		"ac":     1,
+		"ar":     waveformSampleRate,
+		"format": "s16le",
+	}).Compile()
+	cmd := NewCommand(ctx, ffCmd.Args[0], ffCmd.Args[1:]...)
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error generating waveform: %w", err)
+	}
+	if w.written == 0 {
+		return nil, fmt.Errorf("error generating waveform: no output")
+	}
+
+	// Samples are packed as 5 bit values, starting from the lowest bits.
+	waveform := make([]byte, (waveformSamples*5+7)/8)
+	for i, peak := range w.peaks {
+		v := peak * 31 / w.maxPeak
+		for bit := 0; bit < 5; bit++ {
+			if v&(1<<bit) != 0 {
+				pos := i*5 + bit
+				waveform[pos/8] |= 1 << (pos % 8)
+			}
+		}
+	}
+	return waveform, nil
+}
+
+// Returns the duration of the media file at the given path in seconds, or 0 if it can't be probed.
+func getFileDuration(filePath string) float64 {
+	i, err := ffmpeg_go.ProbeWithTimeout(filePath, probeTimeout, nil)
+	if err != nil {
+		fmt.Println("    error probing file:", err)
+		return 0
+	}
+	pd := ffmpegProbeData{}
+	if err := json.Unmarshal([]byte(i), &pd); err != nil {
+		fmt.Println("    error decoding probe result:", err)
+		return 0
+	}
+	d, _ := strconv.ParseFloat(pd.Format.Duration, 64)
+	return d
+}
+
+// Trim sets the converter to only keep the given part of the input. Everything gets re-encoded, so the cut is
+// accurate. Duration is set to the duration of the kept part.
+func (c *Converter) Trim(start, end float64) error {
+	if c.Duration > 0 {
+		if start >= c.Duration {
+			return fmt.Errorf("clip starts after the end of the media (%s)", formatDuration(c.Duration))
+		}
+		end = min(end, c.Duration)
+	}
+	c.TrimStart = start
+	c.TrimEnd = end
+	c.Duration = max(end-start, 0)
+	c.VideoConvertNeeded = true
+	c.AudioConvertNeeded = true
+	return nil
+}
+
+// LimitDuration sets the converter to only keep the given duration of the input. If the input is already
+// trimmed, then the trimmed part gets shortened.
+func (c *Converter) LimitDuration(maxDuration float64) {
+	if c.Duration <= maxDuration {
+		return
+	}
+	if c.TrimEnd > 0 {
+		c.TrimEnd = c.TrimStart + maxDuration
+		c.Duration = maxDuration
+		return
+	}
+	_ = c.Trim(0, maxDuration)
+}
+
+// Returns the ffmpeg input args, which select the part of the input to keep.
+func (c *Converter) getInputArgs() ffmpeg_go.KwArgs {
+	if c.TrimEnd == 0 {
+		return ffmpeg_go.KwArgs{}
+	}
+	return ffmpeg_go.KwArgs{"ss": fmt.Sprint(c.TrimStart), "t": fmt.Sprint(c.TrimEnd - c.TrimStart)}
+}
+
+// SetSubtitles sets the subtitles which get embedded or burned in. Burned in subtitles need the video to be
+// converted.
+func (c *Converter) SetSubtitles(subtitles []SubtitleFile, mode string) {
+	if isAudioFormat(c.Format) || len(subtitles) == 0 || mode == subtitleModeSRT {
+		return
+	}
+	c.Subtitles = subtitles
+	c.SubtitleMode = mode
+	if mode == subtitleModeBurn {
+		c.VideoConvertNeeded = true
+	}
+}
+
+// Returns the ffmpeg video filter which burns in the subtitles, and downscales the video to the given max.
+// height if it's not 0. Returns an empty string if no filter is needed.
+func (c *Converter) getVideoFilter(height int) string {
+	var filters []string
+	if c.SubtitleMode == subtitleModeBurn && len(c.Subtitles) > 0 {
+		filters = append(filters, "subtitles="+c.Subtitles[0].Path)
+	}
+	switch {
+	case c.Format == videoNoteFormat:
+		filters = append(filters, fmt.Sprintf("crop='min(iw,ih)':'min(iw,ih)',scale=%d:%d", c.Width, c.Height))
+	case c.Format == gifFileFormat:
+		// The palette is generated from the video, so the colors look good with GIF's 256 colors.
+		filters = append(filters, fmt.Sprintf("fps=%d,scale=%d:%d:flags=lanczos,split[s0][s1];[s0]palettegen[p];[s1][p]paletteuse",
+			gifFileFPS, c.Width, c.Height))
+	case c.Format == gifFormat:
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", c.Width, c.Height))
+	}
+	if height > 0 {
+		filters = append(filters, fmt.Sprintf("scale=-2:'min(%d,ih)'", height))
+	}
+	return strings.Join(filters, ",")
+}
+
 func (c *Converter) GetActionsNeeded() string {
 	var convertNeeded []string
 	if c.VideoConvertNeeded || c.SingleVideoStreamNeeded {
@@ -189,29 +499,45 @@ func (c *Converter) GetActionsNeeded() string {
 	if c.AudioConvertNeeded || c.SingleAudioStreamNeeded {
 		convertNeeded = append(convertNeeded, "audio")
 	}
+	if c.TrimEnd > 0 {
+		convertNeeded = append(convertNeeded, "clip")
+	}
+	if len(c.Subtitles) > 0 {
+		convertNeeded = append(convertNeeded, "subtitles")
+	}
 	return strings.Join(convertNeeded, ", ")
 }
 
-func (c *Converter) ConvertIfNeeded(ctx context.Context, rr *ReReadCloser) (reader io.ReadCloser, outputFormat string, err error) {
-	reader, writer := io.Pipe()
-	var cmd *Cmd
-
-	fmt.Print("  converting ", c.GetActionsNeeded(), "...\n")
+// Returns the ffmpeg output args and format of the conversion.
+func (c *Converter) getConvertArgs() (args ffmpeg_go.KwArgs, outputFormat string) {
+	if isGIFFormat(c.Format) {
+		return c.getGIFConvertArgs()
+	}
 
 	videoNeeded := true
 	outputFormat = "mp4"
-	if c.Format == "mp3" {
+	af, isAudio := audioFormats[c.Format]
+	if isAudio {
 		videoNeeded = false
-		outputFormat = "mp3"
+		outputFormat = c.Format
+		if af.Ext != "" {
+			outputFormat = af.Ext
+		}
 	}
 
-	args := ffmpeg_go.KwArgs{"format": outputFormat}
+	args = ffmpeg_go.KwArgs{"format": getMuxer(c.Format)}
+	if af.MuxerArgs != nil {
+		args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, af.MuxerArgs})
+	}
 
 	if videoNeeded {
 		args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"movflags": "frag_keyframe+empty_moov+faststart"}})
 
 		if c.VideoConvertNeeded {
 			args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"c:v": "libx264", "crf": 30, "preset": "veryfast"}})
+			if vf := c.getVideoFilter(0); vf != "" {
+				args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"vf": vf}})
+			}
 		} else {
 			args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"c:v": "copy"}})
 		}
@@ -220,8 +546,8 @@ func (c *Converter) ConvertIfNeeded(ctx context.Context, rr *ReReadCloser) (read
 	}
 
 	if c.AudioConvertNeeded {
-		if c.Format == "mp3" {
-			args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"c:a": "mp3", "b:a": "320k"}})
+		if isAudio {
+			args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, af.getEncodeArgs(c.AudioBitrate)})
 		} else {
 			args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"c:a": "mp3", "q:a": 0}})
 		}
@@ -237,43 +563,377 @@ func (c *Converter) ConvertIfNeeded(ctx context.Context, rr *ReReadCloser) (read
 		if c.SingleAudioStreamNeeded {
 			args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"map": "0:a:0"}})
 		}
+
+		var metadata []string
+		for _, t := range [][2]string{
+			{"title", c.Metadata.Title},
+			{"artist", c.Metadata.Artist},
+			{"album", c.Metadata.Album},
+			{"date", c.Metadata.Date},
+		} {
+			if t[1] != "" {
+				metadata = append(metadata, t[0]+"="+t[1])
+			}
+		}
+		if len(metadata) > 0 {
+			args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"metadata": metadata}})
+		}
+	}
+	return
+}
+
+// Returns the ffmpeg output args and format of the animation formats. The audio is dropped.
+func (c *Converter) getGIFConvertArgs() (args ffmpeg_go.KwArgs, outputFormat string) {
+	args = ffmpeg_go.KwArgs{"map": "0:v:0", "an": "", "vf": c.getVideoFilter(0)}
+	if c.Format == gifFileFormat {
+		return ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"format": "gif", "loop": 0}}), "gif"
 	}
+	return ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {
+		"format":   "mp4",
+		"movflags": "frag_keyframe+empty_moov+faststart",
+		"c:v":      "libx264",
+		"crf":      30,
+		"preset":   "veryfast",
+		"pix_fmt":  "yuv420p",
+	}}), "mp4"
+}
 
-	ff := ffmpeg_go.Input("pipe:0").Output("pipe:1", args)
+// Returns the ffmpeg stream which converts the given input to the given output. Audio files get the cover art
+// attached, which is written to a temp file, and cleanup should be called to remove it when ffmpeg is finished.
+// Videos get the subtitles embedded if needed.
+func (c *Converter) getOutputStream(input, output string, args ffmpeg_go.KwArgs) (ff *ffmpeg_go.Stream, cleanup func()) {
+	cleanup = func() {}
+	if !isAudioFormat(c.Format) && c.SubtitleMode == subtitleModeEmbed && len(c.Subtitles) > 0 {
+		return c.getSubtitlesOutputStream(input, output, args), cleanup
+	}
+	if !audioFormats[c.Format].CoverArt || len(c.Metadata.CoverArt) == 0 {
+		return ffmpeg_go.Input(input, c.getInputArgs()).Output(output, args), cleanup
+	}
 
-	var progressSock net.Listener
+	coverFile, err := os.CreateTemp("", "yt-dlp-telegram-bot-cover-*")
+	if err == nil {
+		_, err = coverFile.Write(c.Metadata.CoverArt)
+		coverFile.Close()
+	}
+	if err != nil {
+		fmt.Println("    error writing cover art:", err)
+		if coverFile != nil {
+			os.Remove(coverFile.Name())
+		}
+		return ffmpeg_go.Input(input, c.getInputArgs()).Output(output, args), cleanup
+	}
+
+	args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {
+		"c:v":           "mjpeg",
+		"disposition:v": "attached_pic",
+		"metadata:s:v":  []string{"title=Album cover", "comment=Cover (front)"},
+	}})
+	// Streams are mapped by the stream selectors below.
+	delete(args, "vn")
+	delete(args, "map")
+
+	streams := []*ffmpeg_go.Stream{ffmpeg_go.Input(input, c.getInputArgs()).Get("a:0"), ffmpeg_go.Input(coverFile.Name()).Get("v:0")}
+	return ffmpeg_go.Output(streams, output, args), func() { os.Remove(coverFile.Name()) }
+}
+
+// Returns the ffmpeg stream which converts the given input to the given output, with the subtitles embedded as
+// subtitle tracks.
+func (c *Converter) getSubtitlesOutputStream(input, output string, args ffmpeg_go.KwArgs) *ffmpeg_go.Stream {
+	args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"c:s": "mov_text"}})
+	// Streams are mapped by the stream selectors below.
+	delete(args, "map")
+
+	in := ffmpeg_go.Input(input, c.getInputArgs())
+	streams := []*ffmpeg_go.Stream{in.Get("v:0"), in.Get("a:0?")}
+	for i, sub := range c.Subtitles {
+		streams = append(streams, ffmpeg_go.Input(sub.Path).Get("s:0"))
+		args[fmt.Sprint("metadata:s:s:", i)] = []string{"language=" + sub.Lang, "title=" + sub.Lang}
+	}
+	return ffmpeg_go.Output(streams, output, args)
+}
+
+// Runs the given ffmpeg stream, reporting its progress in the given percent range.
+func (c *Converter) runFFmpeg(ctx context.Context, ff *ffmpeg_go.Stream, stdin io.Reader, stdout io.Writer, progressStr string, startPercent, endPercent int) error {
 	if c.UpdateProgressPercentCallback != nil {
 		if c.Duration > 0 {
-			var progressSockFilename string
-			progressSockFilename, progressSock, err = c.ffmpegProgressSock()
+			progressSockFilename, progressSock, err := c.ffmpegProgressSock(progressStr, startPercent, endPercent)
 			if err == nil {
 				ff = ff.GlobalArgs("-progress", "unix:"+progressSockFilename)
+				defer progressSock.Close()
 			}
 		} else {
-			c.UpdateProgressPercentCallback(processStr, -1)
+			c.UpdateProgressPercentCallback(progressStr, -1)
 		}
 	}
 
-	ffCmd := ff.WithInput(rr).WithOutput(writer).Compile()
+	ffCmd := ff.Compile()
 
 	// Creating a new cmd with a timeout context, which will kill the cmd if it takes too long.
-	cmd = NewCommand(ctx, ffCmd.Args[0], ffCmd.Args[1:]...)
-	cmd.Stdin = ffCmd.Stdin
-	cmd.Stdout = ffCmd.Stdout
+	cmd := NewCommand(ctx, ffCmd.Args[0], ffCmd.Args[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	return cmd.Run()
+}
+
+func (c *Converter) ConvertIfNeeded(ctx context.Context, rr *ReReadCloser) (reader io.ReadCloser, outputFormat string, err error) {
+	reader, writer := io.Pipe()
+
+	fmt.Print("  converting ", c.GetActionsNeeded(), "...\n")
+
+	args, outputFormat := c.getConvertArgs()
+	ff, cleanup := c.getOutputStream("pipe:0", "pipe:1", args)
 
 	// This goroutine handles copying from the input (either rr or cmd.Stdout) to writer.
 	go func() {
-		err = cmd.Run()
-		writer.Close()
-		if progressSock != nil {
-			progressSock.Close()
+		err := c.runFFmpeg(ctx, ff, rr, writer, processStr, 0, 100)
+		if err != nil {
+			err = fmt.Errorf("error converting: %w", err)
 		}
+		writer.CloseWithError(err)
+		cleanup()
 	}()
 
+	return reader, outputFormat, nil
+}
+
+// Returns the video and audio bitrates, and the max. video height which are needed for the output to fit in
+// FitSize. Height is 0 if no downscaling is needed.
+func (c *Converter) getFitSizeEncodeParams() (videoBitrate, audioBitrate, height int, err error) {
+	totalBitrate := int(float64(c.FitSize) * 8 * fitSizeRatio / c.Duration)
+
+	if af, ok := audioFormats[c.Format]; ok {
+		if af.DefaultBitrate == 0 {
+			return 0, 0, 0, fmt.Errorf("%s files can't be compressed to fit in %s", c.Format, humanize.Bytes(uint64(c.FitSize)))
+		}
+		maxBitrate := af.DefaultBitrate
+		if c.AudioBitrate > 0 {
+			maxBitrate = c.AudioBitrate
+		}
+		audioBitrate = min(totalBitrate, maxBitrate*1000)
+		if audioBitrate < fitSizeMinAudioBitrate {
+			return 0, 0, 0, fmt.Errorf("file is too long to fit in %s", humanize.Bytes(uint64(c.FitSize)))
+		}
+		return 0, audioBitrate, 0, nil
+	}
+
+	audioBitrate = max(min(totalBitrate/8, fitSizeMaxAudioBitrate), fitSizeMinAudioBitrate)
+	videoBitrate = totalBitrate - audioBitrate
+	if videoBitrate < fitSizeMinVideoBitrate {
+		return 0, 0, 0, fmt.Errorf("file is too long to fit in %s", humanize.Bytes(uint64(c.FitSize)))
+	}
+
+	// Lower bitrates look better in lower resolutions.
+	for _, h := range fitSizeHeights {
+		if videoBitrate < h.minBitrate {
+			height = h.height
+		}
+	}
+	return videoBitrate, audioBitrate, height, nil
+}
+
+// Writes the input to a temp file and converts it to another temp file. If the converted file is larger than
+// FitSize, then the input gets re-encoded with a bitrate calculated from the duration, so it fits in FitSize. Video
+// is encoded in two passes. Compressing takes longer than a conversion, so every ffmpeg run gets the given timeout.
+func (c *Converter) ConvertToFitSize(ctx context.Context, rr *ReReadCloser, timeout time.Duration) (reader io.ReadCloser, outputFormat string, err error) {
+	dir, err := os.MkdirTemp("", "yt-dlp-telegram-bot-fit-*")
 	if err != nil {
-		writer.Close()
-		return nil, outputFormat, fmt.Errorf("error converting: %w", err)
+		return nil, "", fmt.Errorf("creating temp dir: %w", err)
 	}
 
+	inputPath := path.Join(dir, "input")
+	f, err := os.Create(inputPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", fmt.Errorf("creating temp file: %w", err)
+	}
+	_, err = io.Copy(f, rr)
+	f.Close()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", fmt.Errorf("writing temp file: %w", err)
+	}
+
+	args, outputFormat := c.getConvertArgs()
+	reader, writer := io.Pipe()
+
+	go func() {
+		err := c.convertFileToFitSize(ctx, dir, inputPath, args, writer, timeout)
+		writer.CloseWithError(err)
+		os.RemoveAll(dir)
+	}()
+
 	return reader, outputFormat, nil
 }
+
+// Runs the given ffmpeg stream with the given timeout.
+func (c *Converter) runFFmpegWithTimeout(ctx context.Context, timeout time.Duration, ff *ffmpeg_go.Stream, stdout io.Writer, progressStr string, startPercent, endPercent int) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return c.runFFmpeg(ctx, ff, nil, stdout, progressStr, startPercent, endPercent)
+}
+
+func (c *Converter) convertFileToFitSize(ctx context.Context, dir, inputPath string, args ffmpeg_go.KwArgs, writer io.Writer, timeout time.Duration) error {
+	fmt.Print("  converting ", c.GetActionsNeeded(), "...\n")
+
+	outputPath := path.Join(dir, "output")
+	ff, cleanup := c.getOutputStream(inputPath, outputPath, args)
+	err := c.runFFmpegWithTimeout(ctx, timeout, ff, nil, processStr, 0, 100)
+	cleanup()
+	if err != nil {
+		return fmt.Errorf("error converting: %w", err)
+	}
+
+	fi, err := os.Stat(outputPath)
+	if err != nil {
+		return fmt.Errorf("checking converted file size: %w", err)
+	}
+	if fi.Size() <= c.FitSize {
+		f, err := os.Open(outputPath)
+		if err != nil {
+			return fmt.Errorf("opening converted file: %w", err)
+		}
+		defer f.Close()
+		_, err = io.Copy(writer, f)
+		return err
+	}
+	os.Remove(outputPath)
+
+	if c.Duration <= 0 {
+		return fmt.Errorf("can't compress file with unknown duration")
+	}
+	videoBitrate, audioBitrate, height, err := c.getFitSizeEncodeParams()
+	if err != nil {
+		return err
+	}
+
+	if height > 0 {
+		// The output is autorotated, and it gets downscaled to the given height.
+		c.Width, c.Height = c.GetDisplaySize()
+		c.Rotation = 0
+		if c.Height > height {
+			c.Width = c.Width * height / c.Height / 2 * 2
+			c.Height = height
+		}
+	}
+
+	progressStr := fmt.Sprint(compressStr, " ", humanize.Bytes(uint64(c.FitSize)))
+	fmt.Println("  compressing", fi.Size(), "bytes to fit", c.FitSize, "bytes, video bitrate:", videoBitrate,
+		"audio bitrate:", audioBitrate, "max. height:", height)
+
+	args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"b:a": fmt.Sprint(audioBitrate)}})
+	if af, ok := audioFormats[c.Format]; ok {
+		args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"c:a": af.Codec}})
+
+		ff, cleanup := c.getOutputStream(inputPath, "pipe:1", args)
+		defer cleanup()
+		if err := c.runFFmpegWithTimeout(ctx, timeout, ff, writer, progressStr, 0, 100); err != nil {
+			return fmt.Errorf("error compressing: %w", err)
+		}
+		return nil
+	}
+
+	passArgs := ffmpeg_go.KwArgs{
+		"c:v":         "libx264",
+		"b:v":         fmt.Sprint(videoBitrate),
+		"preset":      "veryfast",
+		"passlogfile": path.Join(dir, "pass"),
+		"map":         []string{"0:v:0", "0:a:0?"},
+	}
+	if vf := c.getVideoFilter(height); vf != "" {
+		passArgs["vf"] = vf
+	}
+	delete(args, "crf")
+	delete(args, "q:a")
+	args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, passArgs, {"c:a": "aac", "pass": 2}})
+	pass1Args := ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{passArgs, {"format": "null", "an": "", "pass": 1}})
+
+	ff = ffmpeg_go.Input(inputPath, c.getInputArgs()).Output(os.DevNull, pass1Args).OverWriteOutput()
+	err = c.runFFmpegWithTimeout(ctx, timeout, ff, nil, progressStr, 0, 50)
+	if err == nil {
+		ff, cleanup := c.getOutputStream(inputPath, "pipe:1", args)
+		err = c.runFFmpegWithTimeout(ctx, timeout, ff, writer, progressStr, 50, 100)
+		cleanup()
+	}
+	if err != nil {
+		return fmt.Errorf("error compressing: %w", err)
+	}
+	return nil
+}
+
+// Split cuts the file at the given path into parts of max. maxPartSize bytes. The file is cut at keyframes, and
+// every part is a separately playable file. The segment length is calculated from the duration and the average
+// bitrate, and it's shortened and the split is retried if a part still turns out to be too big. The returned
+// parts are in a temp dir which should be removed by the caller.
+func (c *Converter) Split(ctx context.Context, filePath string, size, maxPartSize int64, outputFormat string) (dir string, parts []string, err error) {
+	if c.Duration <= 0 {
+		return "", nil, fmt.Errorf("can't split file with unknown duration")
+	}
+
+	dir, err = os.MkdirTemp("", "yt-dlp-telegram-bot-split-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating split temp dir: %w", err)
+	}
+
+	bitrate := float64(size) * 8 / c.Duration
+	segmentTime := float64(maxPartSize) * 8 / bitrate * splitSegmentTimeRatio
+
+	for attempt := 1; attempt <= splitMaxAttempts; attempt++ {
+		fmt.Printf("  splitting to %.0fs parts (attempt %d)...\n", segmentTime, attempt)
+		parts, err = c.splitToSegments(ctx, filePath, path.Join(dir, "part-%03d."+outputFormat), segmentTime, outputFormat)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+
+		var largestPartSize int64
+		for _, p := range parts {
+			fi, err := os.Stat(p)
+			if err != nil {
+				os.RemoveAll(dir)
+				return "", nil, fmt.Errorf("checking part size: %w", err)
+			}
+			largestPartSize = max(largestPartSize, fi.Size())
+		}
+		if largestPartSize <= maxPartSize {
+			return dir, parts, nil
+		}
+
+		fmt.Println("    largest part is too big:", largestPartSize)
+		for _, p := range parts {
+			os.Remove(p)
+		}
+		segmentTime *= float64(maxPartSize) / float64(largestPartSize) * splitSegmentTimeRatio
+	}
+
+	os.RemoveAll(dir)
+	return "", nil, fmt.Errorf("can't split file to parts smaller than %d bytes", maxPartSize)
+}
+
+func (c *Converter) splitToSegments(ctx context.Context, filePath, outputPattern string, segmentTime float64, outputFormat string) (parts []string, err error) {
+	args := ffmpeg_go.KwArgs{
+		"c":                "copy",
+		"map":              "0",
+		"f":                "segment",
+		"segment_time":     fmt.Sprintf("%.3f", segmentTime),
+		"segment_format":   getMuxer(c.Format),
+		"reset_timestamps": 1,
+	}
+	if outputFormat == "mp4" || outputFormat == "m4a" {
+		args = ffmpeg_go.MergeKwArgs([]ffmpeg_go.KwArgs{args, {"segment_format_options": "movflags=+faststart"}})
+	}
+
+	ff := ffmpeg_go.Input(filePath).Output(outputPattern, args).OverWriteOutput()
+	if err = c.runFFmpeg(ctx, ff, nil, nil, processStr, 0, 100); err != nil {
+		return nil, fmt.Errorf("error splitting: %w", err)
+	}
+
+	parts, err = filepath.Glob(strings.Replace(outputPattern, "%03d", "[0-9][0-9][0-9]", 1))
+	if err != nil || len(parts) == 0 {
+		return nil, fmt.Errorf("error splitting: no parts created")
+	}
+	sort.Strings(parts)
+	return parts, nil
+}
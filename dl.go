@@ -2,23 +2,177 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wader/goutubedl"
 )
 
-const downloadAndConvertTimeout = 5 * time.Minute
+const thumbnailDownloadTimeout = 30 * time.Second
+const maxThumbnailBytes = 10 * 1024 * 1024
+
+// Downloaded clips can be this much longer than requested, as yt-dlp cuts them at keyframes.
+const clipDurationTolerance = 1.2
 
 type ConvertStartCallbackFunc func(ctx context.Context, videoCodecs, audioCodecs, convertActionsNeeded string)
 type UpdateProgressPercentCallbackFunc func(progressStr string, progressPercent int)
 
 type Downloader struct {
+	// Quality can be "best", or the max. video resolution like "720p". Empty means the default quality. For audio
+	// formats it's the bitrate like "192k", empty means the format's default bitrate.
+	Quality string
+
+	// If set, then the given range of playlist items is requested.
+	PlaylistStart int
+	PlaylistEnd   int
+	// If set, then the given playlist item gets downloaded from the playlist.
+	PlaylistIndex int
+
+	// If ClipEnd is set, then only this part of the media is downloaded, in seconds.
+	ClipStart float64
+	ClipEnd   float64
+
+	// If set, then the subtitles of these languages are downloaded, and used depending on SubtitleMode.
+	SubtitleLangs []string
+	SubtitleMode  string
+
+	// If set, then the output gets compressed to fit in this size.
+	FitSize int64
+
+	// Max. time of downloading and converting, the returned result's reader fails after it. Not limited if 0.
+	Timeout time.Duration
+
 	ConvertStartFunc          ConvertStartCallbackFunc
 	UpdateProgressPercentFunc UpdateProgressPercentCallbackFunc
 }
 
+// PlaylistItem is an item of a playlist. URL is empty if the item doesn't have its own URL, so it can only be
+// downloaded from the playlist using its index.
+type PlaylistItem struct {
+	Index int
+	URL   string
+}
+
+// PlaylistError is returned by the Downloader if the requested URL is a playlist. The playlist items should be
+// requested one by one.
+type PlaylistError struct {
+	Title string
+	Items []PlaylistItem
+}
+
+func (e *PlaylistError) Error() string {
+	return "url is a playlist"
+}
+
+func newPlaylistError(url string, info goutubedl.Info, firstIndex int) *PlaylistError {
+	e := &PlaylistError{Title: info.Title}
+	for i, entry := range info.Entries {
+		if len(e.Items) >= params.MaxPlaylistItems {
+			break
+		}
+
+		item := PlaylistItem{Index: int(entry.PlaylistIndex)}
+		if item.Index == 0 {
+			item.Index = firstIndex + i
+		}
+		// Items of multi-video posts have the URL of the post.
+		if entry.WebpageURL != url && entry.WebpageURL != info.WebpageURL {
+			item.URL = entry.WebpageURL
+		}
+		e.Items = append(e.Items, item)
+	}
+	return e
+}
+
+func isPlaylistInfo(info goutubedl.Info) bool {
+	return info.Type == "playlist" || info.Type == "multi_video"
+}
+
+// DownloadResult is the converted output of a download.
+type DownloadResult struct {
+	Reader       io.ReadCloser
+	OutputFormat string
+	Title        string
+	Uploader     string
+	// The converter which was used for the conversion, holding the probed information.
+	Conv *Converter
+	// Downloaded subtitles in SRT format, they are in subtitlesDir.
+	Subtitles    []SubtitleFile
+	subtitlesDir string
+
+	convertCtxCancel context.CancelFunc
+}
+
+// Cleanup removes the temp files of the result. It should be called when the result is not used anymore.
+func (r *DownloadResult) Cleanup() {
+	if r.convertCtxCancel != nil {
+		r.convertCtxCancel()
+	}
+	if r.subtitlesDir != "" {
+		os.RemoveAll(r.subtitlesDir)
+	}
+}
+
+// MediaMetadata is embedded in the audio files as tags.
+type MediaMetadata struct {
+	Title  string
+	Artist string
+	Album  string
+	// Format is YYYY-MM-DD.
+	Date     string
+	CoverArt []byte
+}
+
+func getMediaMetadata(info goutubedl.Info) (m MediaMetadata) {
+	m.Title = info.Track
+	if m.Title == "" {
+		m.Title = info.Title
+	}
+	m.Artist = info.Artist
+	if m.Artist == "" {
+		m.Artist = info.Creator
+	}
+	if m.Artist == "" {
+		m.Artist = info.Uploader
+	}
+	m.Album = info.Album
+	if len(info.UploadDate) == 8 {
+		m.Date = info.UploadDate[:4] + "-" + info.UploadDate[4:6] + "-" + info.UploadDate[6:]
+	}
+	return
+}
+
+// Downloads the thumbnail from the given URL, which is used as the cover art of audio files.
+func downloadThumbnail(ctx context.Context, url string) ([]byte, error) {
+	return httpGet(ctx, url, thumbnailDownloadTimeout, maxThumbnailBytes)
+}
+
+// Returns the contents of the given URL, max. maxBytes are read.
+func httpGet(ctx context.Context, url string, timeout time.Duration, maxBytes int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxBytes))
+}
+
 type goYouTubeDLLogger struct{}
 
 func (l goYouTubeDLLogger) Print(v ...interface{}) {
@@ -26,49 +180,204 @@ func (l goYouTubeDLLogger) Print(v ...interface{}) {
 	fmt.Println(v...)
 }
 
-func (d *Downloader) downloadURL(dlCtx context.Context, url string) (rr *ReReadCloser, title string, err error) {
-	result, err := goutubedl.New(dlCtx, url, goutubedl.Options{
+func isValidQuality(quality string) bool {
+	if quality == "best" {
+		return true
+	}
+	res, err := strconv.Atoi(strings.TrimSuffix(quality, "p"))
+	return err == nil && res > 0
+}
+
+// Returns the yt-dlp format sorting string for the given quality.
+func getSortingFormat(quality string) string {
+	if quality == "" {
+		quality = params.DefaultQuality
+	}
+	if quality == "best" {
+		return ""
+	}
+	// Prefer videos no larger than the given resolution to keep their size small.
+	return "res:" + strings.TrimSuffix(quality, "p")
+}
+
+// Returns the yt-dlp download sections arg for the clip range.
+func (d *Downloader) getDownloadSections() string {
+	if d.ClipEnd == 0 {
+		return ""
+	}
+	return "*" + strconv.FormatFloat(d.ClipStart, 'f', -1, 64) + "-" + strconv.FormatFloat(d.ClipEnd, 'f', -1, 64)
+}
+
+// Downloads the given URL. If a clip range is set, then clipped is true if yt-dlp could download only the clip.
+func (d *Downloader) downloadURL(dlCtx context.Context, url, format string) (rr *ReReadCloser, info goutubedl.Info, clipped bool, err error) {
+	opts := goutubedl.Options{
 		Type:     goutubedl.TypeSingle,
 		DebugLog: goYouTubeDLLogger{},
 		// StderrFn:          func(cmd *exec.Cmd) io.Writer { return io.Writer(os.Stdout) },
-		MergeOutputFormat: "mkv",     // This handles VP9 properly. yt-dlp uses mp4 by default, which doesn't.
-		SortingFormat:     "res:720", // Prefer videos no larger than 720p to keep their size small.
-	})
+		MergeOutputFormat: "mkv", // This handles VP9 properly. yt-dlp uses mp4 by default, which doesn't.
+		SortingFormat:     getSortingFormat(d.Quality),
+		DownloadSections:  d.getDownloadSections(),
+	}
+	if isAudioFormat(format) {
+		opts.SortingFormat = ""
+	} else if format == videoNoteFormat && d.Quality == "" {
+		// No need for a larger video than the max. video note size.
+		opts.SortingFormat = getSortingFormat(fmt.Sprint(videoNoteMaxSize))
+	} else if isGIFFormat(format) && d.Quality == "" {
+		opts.SortingFormat = getSortingFormat(fmt.Sprint(gifMaxSize))
+	}
+	switch {
+	case d.PlaylistIndex > 0:
+		opts.Type = goutubedl.TypeAny
+	case d.PlaylistStart > 0:
+		opts.Type = goutubedl.TypePlaylist
+		opts.PlaylistStart = uint(d.PlaylistStart)
+		opts.PlaylistEnd = uint(d.PlaylistEnd)
+	}
+
+	result, err := goutubedl.New(dlCtx, url, opts)
+	if errors.Is(err, goutubedl.ErrNotASingleEntry) {
+		// Only getting info for the first items of the playlist.
+		opts.Type = goutubedl.TypePlaylist
+		opts.PlaylistStart = 1
+		opts.PlaylistEnd = uint(params.MaxPlaylistItems)
+		result, err = goutubedl.New(dlCtx, url, opts)
+	} else if errors.Is(err, goutubedl.ErrNotAPlaylist) {
+		return nil, info, false, fmt.Errorf("a playlist item range was given, but %q is not a playlist", url)
+	}
 	if err != nil {
-		return nil, "", fmt.Errorf("preparing download %q: %w", url, err)
+		return nil, info, false, fmt.Errorf("preparing download %q: %w", url, err)
 	}
 
-	dlResult, err := result.Download(dlCtx, "")
+	if d.PlaylistIndex == 0 && isPlaylistInfo(result.Info) {
+		return nil, info, false, newPlaylistError(url, result.Info, max(int(opts.PlaylistStart), 1))
+	}
+
+	dlOptions := goutubedl.DownloadOptions{
+		PlaylistIndex: d.PlaylistIndex,
+	}
+	if af, ok := audioFormats[format]; ok {
+		// No need to download the video stream.
+		dlOptions.Filter = af.DownloadFilter
+	} else if isGIFFormat(format) {
+		// Animations have no audio.
+		dlOptions.Filter = "bestvideo/best"
+	}
+
+	info = result.Info
+	for _, entry := range result.Info.Entries {
+		if int(entry.PlaylistIndex) == d.PlaylistIndex {
+			info = entry
+			break
+		}
+	}
+	if len(d.SubtitleLangs) > 0 && d.PlaylistIndex == 0 {
+		addAutomaticCaptions(&info, result.RawJSON)
+	}
+
+	dlResult, err := result.DownloadWithOptions(dlCtx, dlOptions)
+	if err != nil && result.Options.DownloadSections != "" {
+		// The clip will be cut from the whole download.
+		fmt.Println("  can't download clip, downloading whole media:", err)
+		result.Options.DownloadSections = ""
+		dlResult, err = result.DownloadWithOptions(dlCtx, dlOptions)
+	}
 	if err != nil {
-		return nil, "", fmt.Errorf("downloading %q: %w", url, err)
+		return nil, info, false, fmt.Errorf("downloading %q: %w", url, err)
 	}
 
-	return NewReReadCloser(dlResult), result.Info.Title, nil
+	return NewReReadCloser(dlResult), info, result.Options.DownloadSections != "", nil
 }
 
-func (d *Downloader) DownloadAndConvertURL(ctx context.Context, url, format string) (r io.ReadCloser, outputFormat, title string, err error) {
-	rr, title, err := d.downloadURL(ctx, url)
+func (d *Downloader) DownloadAndConvertURL(ctx context.Context, url, format string) (res *DownloadResult, err error) {
+	convertCtx, convertCtxCancel := ctx, context.CancelFunc(func() {})
+	if d.Timeout > 0 {
+		convertCtx, convertCtxCancel = context.WithTimeout(ctx, d.Timeout)
+	}
+	defer func() {
+		if err != nil {
+			convertCtxCancel()
+		}
+	}()
+
+	rr, info, clipped, err := d.downloadURL(convertCtx, url, format)
 	if err != nil {
-		return nil, "", "", err
+		return nil, err
+	}
+	if d.ClipEnd > 0 {
+		info.Title += " (" + getClipStr(d.ClipStart, d.ClipEnd) + ")"
 	}
 
-	conv := Converter{
-		Format:                        format,
-		UpdateProgressPercentCallback: d.UpdateProgressPercentFunc,
+	res = &DownloadResult{
+		Title:    info.Title,
+		Uploader: info.Uploader,
+		Conv: &Converter{
+			Format:                        format,
+			Metadata:                      getMediaMetadata(info),
+			FitSize:                       d.FitSize,
+			AudioBitrate:                  parseAudioBitrate(d.Quality),
+			UpdateProgressPercentCallback: d.UpdateProgressPercentFunc,
+		},
+		convertCtxCancel: convertCtxCancel,
 	}
 
-	if err := conv.Probe(rr); err != nil {
-		return nil, "", "", err
+	if err := res.Conv.Probe(rr); err != nil {
+		return nil, err
+	}
+
+	if d.ClipEnd > 0 {
+		clipDuration := d.ClipEnd - d.ClipStart
+		// Some extractors ignore the download sections, then the download is as long as the whole media.
+		whole := !clipped || res.Conv.Duration >= d.ClipEnd || (info.Duration > 0 && res.Conv.Duration >= info.Duration-1)
+		if whole {
+			fmt.Println("  got", res.Conv.Duration, "seconds, cutting the clip")
+			if err := res.Conv.Trim(d.ClipStart, d.ClipEnd); err != nil {
+				return nil, err
+			}
+		} else if res.Conv.Duration > clipDuration*clipDurationTolerance+1 {
+			// The clip is cut at keyframes, so it can be longer. It already starts at the clip start.
+			fmt.Println("  got", res.Conv.Duration, "seconds, shortening the clip")
+			if err := res.Conv.Trim(0, clipDuration); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if maxDuration := getMaxDuration(format); maxDuration > 0 && res.Conv.Duration > maxDuration {
+		fmt.Println("  got", res.Conv.Duration, "seconds, cutting to the max. duration of the format")
+		res.Conv.LimitDuration(maxDuration)
+	}
+
+	if len(d.SubtitleLangs) > 0 {
+		// The media is still sent without subtitles.
+		res.subtitlesDir, res.Subtitles, err = d.downloadSubtitles(convertCtx, info)
+		if err != nil {
+			fmt.Println("  error getting subtitles:", err)
+		}
+		res.Conv.SetSubtitles(res.Subtitles, d.SubtitleMode)
+	}
+
+	if audioFormats[format].CoverArt && info.Thumbnail != "" {
+		res.Conv.Metadata.CoverArt, err = downloadThumbnail(convertCtx, info.Thumbnail)
+		if err != nil {
+			fmt.Println("  error downloading thumbnail:", err)
+		}
 	}
 
 	if d.ConvertStartFunc != nil {
-		d.ConvertStartFunc(ctx, conv.VideoCodecs, conv.AudioCodecs, conv.GetActionsNeeded())
+		d.ConvertStartFunc(ctx, res.Conv.VideoCodecs, res.Conv.AudioCodecs, res.Conv.GetActionsNeeded())
 	}
 
-	r, outputFormat, err = conv.ConvertIfNeeded(ctx, rr)
+	if d.FitSize > 0 && !isGIFFormat(format) {
+		// Animations are short and small, so they are not compressed. Compressing can take much longer than a
+		// conversion, so each of its ffmpeg runs gets the whole timeout.
+		res.Reader, res.OutputFormat, err = res.Conv.ConvertToFitSize(ctx, rr, d.Timeout)
+	} else {
+		res.Reader, res.OutputFormat, err = res.Conv.ConvertIfNeeded(convertCtx, rr)
+	}
 	if err != nil {
-		return nil, "", "", err
+		res.Cleanup()
+		return nil, err
 	}
 
-	return r, outputFormat, title, nil
+	return res, nil
 }
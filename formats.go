@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+	"golang.org/x/exp/slices"
+)
+
+// Bitrates which can be requested for the lossy audio formats, in kbit/s.
+const minAudioBitrate = 32
+const maxAudioBitrate = 320
+
+// Video notes are square videos with a max. size and duration.
+const videoNoteFormat = "note"
+const videoNoteMaxSize = 640
+const videoNoteMaxDuration = 60
+
+const voiceFormat = "voice"
+
+// Animations are silent, looping videos with a max. size and duration. The gif format is sent as an H.264 MP4
+// animation, the giffile format as a real .gif file.
+const gifFormat = "gif"
+const gifFileFormat = "giffile"
+const gifMaxSize = 480
+const gifMaxDuration = 30
+const gifFileFPS = 15
+
+// Video formats which can be requested besides the default video format.
+var videoFormats = []string{videoNoteFormat, gifFormat, gifFileFormat}
+
+type audioFormat struct {
+	// ffmpeg encoder and muxer of the format.
+	Codec string
+	Muxer string
+	// Extra muxer args.
+	MuxerArgs ffmpeg_go.KwArgs
+	// File extension, the format's name is used if it's empty.
+	Ext string
+	// If set, then the audio is downmixed to this number of channels.
+	Channels int
+	// Source codecs which are copied without re-encoding.
+	CopyCodecs []string
+	// Default bitrate in kbit/s. It's 0 for lossless formats.
+	DefaultBitrate int
+	// yt-dlp format filter, which prefers sources which can be copied.
+	DownloadFilter string
+	MIME           string
+	// Set if the container can hold the cover art.
+	CoverArt bool
+}
+
+// Audio only output formats.
+var audioFormats = map[string]audioFormat{
+	"mp3": {
+		Codec:          "mp3",
+		Muxer:          "mp3",
+		CopyCodecs:     []string{"mp3"},
+		DefaultBitrate: 320,
+		DownloadFilter: "bestaudio/best",
+		MIME:           "audio/mpeg",
+		CoverArt:       true,
+	},
+	"m4a": {
+		Codec: "aac",
+		Muxer: "ipod",
+		// The output is written to a pipe, so the index can't be written at the end.
+		MuxerArgs:      ffmpeg_go.KwArgs{"movflags": "frag_keyframe+empty_moov"},
+		CopyCodecs:     []string{"aac"},
+		DefaultBitrate: 192,
+		DownloadFilter: "bestaudio[acodec^=mp4a]/bestaudio/best",
+		MIME:           "audio/mp4",
+		CoverArt:       true,
+	},
+	"opus": {
+		Codec:          "libopus",
+		Muxer:          "ogg",
+		CopyCodecs:     []string{"opus"},
+		DefaultBitrate: 128,
+		DownloadFilter: "bestaudio[acodec=opus]/bestaudio/best",
+		MIME:           "audio/ogg",
+	},
+	"flac": {
+		Codec:          "flac",
+		Muxer:          "flac",
+		CopyCodecs:     []string{"flac"},
+		DownloadFilter: "bestaudio/best",
+		MIME:           "audio/flac",
+		CoverArt:       true,
+	},
+	"wav": {
+		Codec:          "pcm_s16le",
+		Muxer:          "wav",
+		CopyCodecs:     []string{"pcm_s16le"},
+		DownloadFilter: "bestaudio/best",
+		MIME:           "audio/wav",
+	},
+	// Sent as a voice message.
+	voiceFormat: {
+		Codec:          "libopus",
+		Muxer:          "ogg",
+		Ext:            "ogg",
+		Channels:       1,
+		DefaultBitrate: 64,
+		DownloadFilter: "bestaudio/best",
+		MIME:           "audio/ogg",
+	},
+}
+
+func isAudioFormat(format string) bool {
+	_, ok := audioFormats[format]
+	return ok
+}
+
+func isGIFFormat(format string) bool {
+	return format == gifFormat || format == gifFileFormat
+}
+
+// Returns true if the given string is the name of a format which can be requested.
+func isValidFormat(format string) bool {
+	return isAudioFormat(format) || slices.Contains(videoFormats, format)
+}
+
+// Returns the max. duration of the given format in seconds, or 0 if it's not limited.
+func getMaxDuration(format string) float64 {
+	switch {
+	case format == videoNoteFormat:
+		return videoNoteMaxDuration
+	case isGIFFormat(format):
+		return gifMaxDuration
+	}
+	return 0
+}
+
+// Returns true if the bitrate of the given format can be set.
+func isLossyAudioFormat(format string) bool {
+	return audioFormats[format].DefaultBitrate > 0
+}
+
+// Returns true if the given format is sent as an audio or video document which can be put in an album. Voice
+// messages, video notes and animations can't.
+func isAlbumFormat(format string) bool {
+	return format != voiceFormat && format != videoNoteFormat && format != gifFormat
+}
+
+// Returns the ffmpeg muxer of the given output format.
+func getMuxer(format string) string {
+	if af, ok := audioFormats[format]; ok {
+		return af.Muxer
+	}
+	return "mp4"
+}
+
+// Parses audio bitrates like "192k" to kbit/s. Returns 0 if the given string is not a valid bitrate.
+func parseAudioBitrate(s string) int {
+	b, err := strconv.Atoi(strings.TrimSuffix(s, "k"))
+	if err != nil || !strings.HasSuffix(s, "k") || b < minAudioBitrate || b > maxAudioBitrate {
+		return 0
+	}
+	return b
+}
+
+// Returns the ffmpeg args for encoding audio in the given format with the given bitrate in kbit/s. The format's
+// default bitrate is used if the bitrate is 0.
+func (af audioFormat) getEncodeArgs(bitrate int) ffmpeg_go.KwArgs {
+	args := ffmpeg_go.KwArgs{"c:a": af.Codec}
+	if af.DefaultBitrate > 0 {
+		if bitrate == 0 {
+			bitrate = af.DefaultBitrate
+		}
+		args["b:a"] = strconv.Itoa(bitrate) + "k"
+	}
+	if af.Channels > 0 {
+		args["ac"] = af.Channels
+	}
+	return args
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
 
 	"github.com/gotd/td/tg"
+	"golang.org/x/exp/slices"
 )
 
 // Helper function to pretty-print any Telegram API object to find out which it needs to be cast to.
@@ -38,16 +42,265 @@ func getProgressbar(progressPercent, progressBarLen int) (progressBar string) {
 	return
 }
 
-func resolveMsgSrc(msg *tg.Message) (fromUser *tg.PeerUser, fromGroup *tg.PeerChat) {
-	fromGroup, isGroupMsg := msg.PeerID.(*tg.PeerChat)
-	if isGroupMsg {
-		fromUser = msg.FromID.(*tg.PeerUser)
-	} else {
-		fromUser = msg.PeerID.(*tg.PeerUser)
+// Parses playlist item ranges like "3-10", or "5-5" for a single item. The range is limited to the max. playlist
+// items count.
+func parsePlaylistRange(s string) (start, end int, err error) {
+	startStr, endStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		return 0, 0, fmt.Errorf("invalid playlist item range")
+	}
+	start, err = strconv.Atoi(startStr)
+	if err != nil || start < 1 {
+		return 0, 0, fmt.Errorf("invalid playlist item range")
+	}
+	end, err = strconv.Atoi(endStr)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid playlist item range")
+	}
+	end = min(end, start+params.MaxPlaylistItems-1)
+	return start, end, nil
+}
+
+// Parses timestamps like "1:02:10", "2:10" or "130.5" to seconds.
+func parseTimestamp(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp")
+	}
+	var secs float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid timestamp")
+		}
+		secs = secs*60 + v
+	}
+	return secs, nil
+}
+
+// Parses clip ranges like "1:02:10-1:02:40" to start and end seconds. Both timestamps should have minutes, so
+// clip ranges can't be mistaken for playlist item ranges.
+func parseClipRange(s string) (start, end float64, err error) {
+	startStr, endStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		return 0, 0, fmt.Errorf("invalid clip range")
+	}
+	if !strings.Contains(startStr, ":") || !strings.Contains(endStr, ":") {
+		return 0, 0, fmt.Errorf("invalid clip range, timestamps should be like 1:30 or 0:05")
+	}
+	if start, err = parseTimestamp(startStr); err != nil {
+		return 0, 0, fmt.Errorf("invalid clip range start: %w", err)
+	}
+	if end, err = parseTimestamp(endStr); err != nil {
+		return 0, 0, fmt.Errorf("invalid clip range end: %w", err)
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("invalid clip range, end should be after start")
+	}
+	return start, end, nil
+}
+
+// Returns the given seconds like "1:02:10", or "2:10" if it's less than an hour.
+func formatDuration(secs float64) string {
+	s := int(secs)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// Returns the given clip range like "1:02:10-1:02:40".
+func getClipStr(start, end float64) string {
+	return formatDuration(start) + "-" + formatDuration(end)
+}
+
+// Supergroup and channel IDs are shown with this offset and a minus sign (the -100 prefix), like in the Bot API.
+const channelIDOffset = 1000000000000
+
+// Returns the sender and the group of the given message. The group is a *tg.PeerChat for basic groups and a
+// *tg.PeerChannel for supergroups and channels, and it's nil for private messages. Anonymous admins and channel
+// posts have no user sender, for them the returned user's ID is 0.
+func resolveMsgSrc(msg *tg.Message) (fromUser *tg.PeerUser, fromGroup tg.PeerClass) {
+	switch p := msg.PeerID.(type) {
+	case *tg.PeerChat, *tg.PeerChannel:
+		fromGroup = p
+		var ok bool
+		if fromUser, ok = msg.FromID.(*tg.PeerUser); !ok {
+			fromUser = &tg.PeerUser{}
+		}
+	case *tg.PeerUser:
+		fromUser = p
+	}
+	return
+}
+
+// Returns the ID of the given group as shown to users. Group IDs are negative, supergroup and channel IDs also
+// have the -100 prefix.
+func getGroupID(fromGroup tg.PeerClass) int64 {
+	switch p := fromGroup.(type) {
+	case *tg.PeerChat:
+		return -p.ChatID
+	case *tg.PeerChannel:
+		return -(channelIDOffset + p.ChannelID)
+	}
+	return 0
+}
+
+// Returns the ID of the chat where the message came from. Group IDs are negative.
+func getChatID(fromUser *tg.PeerUser, fromGroup tg.PeerClass) int64 {
+	if fromGroup != nil {
+		return getGroupID(fromGroup)
+	}
+	return fromUser.UserID
+}
+
+// Returns the ID of the forum topic of the given message, or 0 if the message is not in a topic.
+func getTopicID(msg *tg.Message) int {
+	h, ok := msg.ReplyTo.(*tg.MessageReplyHeader)
+	if !ok || !h.ForumTopic {
+		return 0
+	}
+	// Messages which don't reply to another message in the topic have the topic ID as their reply ID.
+	if h.ReplyToTopID != 0 {
+		return h.ReplyToTopID
+	}
+	return h.ReplyToMsgID
+}
+
+func getInputPeer(entities tg.Entities, fromUser *tg.PeerUser, fromGroup tg.PeerClass) tg.InputPeerClass {
+	switch p := fromGroup.(type) {
+	case *tg.PeerChat:
+		return &tg.InputPeerChat{ChatID: p.ChatID}
+	case *tg.PeerChannel:
+		var accessHash int64
+		if channel, ok := entities.Channels[p.ChannelID]; ok {
+			accessHash = channel.AccessHash
+		}
+		return &tg.InputPeerChannel{ChannelID: p.ChannelID, AccessHash: accessHash}
+	}
+
+	var accessHash int64
+	if user, ok := entities.Users[fromUser.UserID]; ok {
+		accessHash = user.AccessHash
+	}
+	return &tg.InputPeerUser{UserID: fromUser.UserID, AccessHash: accessHash}
+}
+
+// Returns the part of the given text at the given offset and length in UTF-16 code units, as message entities
+// are positioned this way.
+func getEntityText(s string, offset, length int) string {
+	u := utf16.Encode([]rune(s))
+	if offset < 0 || length < 0 || offset+length > len(u) {
+		return ""
+	}
+	return string(utf16.Decode(u[offset : offset+length]))
+}
+
+// Returns the texts of the given message's URL entities, as they appear in the message.
+func getMsgURLEntityTexts(msg *tg.Message) (texts []string) {
+	for _, e := range msg.Entities {
+		if e, ok := e.(*tg.MessageEntityURL); ok {
+			if t := getEntityText(msg.Message, e.Offset, e.Length); t != "" {
+				texts = append(texts, t)
+			}
+		}
+	}
+	return
+}
+
+// Returns the first http(s) URL of the given message's URL and text link entities, or an empty string if the
+// message has no URLs.
+func getMsgURL(msg *tg.Message) string {
+	if urls := getMsgURLs(msg); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+// Max. number of URLs processed from a message.
+const maxMsgURLs = 5
+
+// Returns the http(s) URLs of the given message's URL and text link entities. URLs pointing to the same media are
+// only returned once.
+func getMsgURLs(msg *tg.Message) (urls []string) {
+	var normalizedURLs []string
+	for _, e := range msg.Entities {
+		var u string
+		switch e := e.(type) {
+		case *tg.MessageEntityURL:
+			u = getEntityText(msg.Message, e.Offset, e.Length)
+		case *tg.MessageEntityTextURL:
+			u = e.URL
+		default:
+			continue
+		}
+		if !strings.Contains(u, "://") {
+			// Telegram also detects URLs without a scheme.
+			u = "https://" + u
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			continue
+		}
+		if n := normalizeURL(u); !slices.Contains(normalizedURLs, n) {
+			normalizedURLs = append(normalizedURLs, n)
+			urls = append(urls, u)
+		}
 	}
 	return
 }
 
+// Returns the message with the given ID. The peer is only needed for supergroup and channel messages, as
+// their IDs are only valid with the channel.
+func getMessage(ctx context.Context, peer tg.InputPeerClass, msgID int) (*tg.Message, error) {
+	var res tg.MessagesMessagesClass
+	var err error
+	msgIDs := []tg.InputMessageClass{&tg.InputMessageID{ID: msgID}}
+	if p, ok := peer.(*tg.InputPeerChannel); ok {
+		res, err = telegramAPI.ChannelsGetMessages(ctx, &tg.ChannelsGetMessagesRequest{
+			Channel: &tg.InputChannel{ChannelID: p.ChannelID, AccessHash: p.AccessHash},
+			ID:      msgIDs,
+		})
+	} else {
+		res, err = telegramAPI.MessagesGetMessages(ctx, msgIDs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting message: %w", err)
+	}
+	if modified, ok := res.AsModified(); ok {
+		for _, m := range modified.GetMessages() {
+			if msg, ok := m.(*tg.Message); ok && msg.ID == msgID {
+				return msg, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("message not found")
+}
+
+// Returns the ID of the message which the given message replies to, or 0 if it's not a reply. Messages in forum
+// topics which only have the topic as their reply are not replies.
+func getReplyToMsgID(msg *tg.Message) int {
+	h, ok := msg.ReplyTo.(*tg.MessageReplyHeader)
+	if !ok || h.ReplyToPeerID != nil || (h.ForumTopic && h.ReplyToTopID == 0) {
+		return 0
+	}
+	return h.ReplyToMsgID
+}
+
+// Returns the ID of the message sent by the request which resulted in the given updates.
+func getSentMsgID(upd tg.UpdatesClass) (int, error) {
+	switch u := upd.(type) {
+	case *tg.UpdateShortSentMessage:
+		return u.ID, nil
+	case *tg.Updates:
+		for _, update := range u.Updates {
+			if m, ok := update.(*tg.UpdateMessageID); ok {
+				return m.ID, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no message id in updates %T", upd)
+}
+
 func getFromUsername(entities tg.Entities, fromUID int64) string {
 	if fromUser, ok := entities.Users[fromUID]; ok {
 		if un, ok := fromUser.GetUsername(); ok {
@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestParsePlaylistRange(t *testing.T) {
+	params.MaxPlaylistItems = 10
+	tests := []struct {
+		s          string
+		start, end int
+		wantErr    bool
+	}{
+		{s: "3-10", start: 3, end: 10},
+		{s: "5-5", start: 5, end: 5},
+		{s: "1-100", start: 1, end: 10},
+		{s: "20-25", start: 20, end: 25},
+		{s: "5", wantErr: true},
+		{s: "0-3", wantErr: true},
+		{s: "5-3", wantErr: true},
+		{s: "-3", wantErr: true},
+		{s: "3-", wantErr: true},
+		{s: "3-5-7", wantErr: true},
+		{s: "-", wantErr: true},
+	}
+	for _, tt := range tests {
+		start, end, err := parsePlaylistRange(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePlaylistRange(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if start != tt.start || end != tt.end {
+			t.Errorf("parsePlaylistRange(%q) = %d, %d, want %d, %d", tt.s, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    float64
+		wantErr bool
+	}{
+		{s: "130.5", want: 130.5},
+		{s: "2:10", want: 130},
+		{s: "1:02:10", want: 3730},
+		{s: "0:05", want: 5},
+		{s: "0:59.5", want: 59.5},
+		{s: "1:60", wantErr: true},
+		{s: "1:2:3:4", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "", wantErr: true},
+		{s: "1:", wantErr: true},
+		{s: "a:10", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimestamp(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseClipRange(t *testing.T) {
+	tests := []struct {
+		s          string
+		start, end float64
+		wantErr    bool
+	}{
+		{s: "1:02:10-1:02:40", start: 3730, end: 3760},
+		{s: "2:00-2:30", start: 120, end: 150},
+		{s: "0:05-1:30.5", start: 5, end: 90.5},
+		{s: "90-120", wantErr: true},
+		{s: "1:30-120", wantErr: true},
+		{s: "2:30-2:00", wantErr: true},
+		{s: "2:00-2:00", wantErr: true},
+		{s: "2:00", wantErr: true},
+		{s: "1:60-2:00", wantErr: true},
+		{s: "-2:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		start, end, err := parseClipRange(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClipRange(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if start != tt.start || end != tt.end {
+			t.Errorf("parseClipRange(%q) = %v, %v, want %v, %v", tt.s, start, end, tt.start, tt.end)
+		}
+	}
+}
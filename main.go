@@ -20,47 +20,333 @@ import (
 
 var dlQueue DownloadQueue
 
+var telegramAPI *tg.Client
 var telegramUploader *uploader.Uploader
 var telegramSender *message.Sender
 
-func handleCmdDLP(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage, msg *tg.Message) {
+// Returns true if the given URL is an http(s) URL with a resolvable host.
+func isValidURL(s string) bool {
+	uri, err := url.ParseRequestURI(s)
+	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") {
+		return false
+	}
+	_, err = net.LookupHost(uri.Hostname())
+	return err == nil
+}
+
+// Returns true if the given message is a command.
+func isCmdMsg(msg *tg.Message) bool {
+	return strings.HasPrefix(msg.Message, "/") || strings.HasPrefix(msg.Message, "!")
+}
+
+// Returns the valid URLs of the given message. If withReply is set, the message has no URLs and it's a reply, then
+// the URLs of the replied message are returned. Max. maxMsgURLs are returned.
+func getRequestURLs(ctx context.Context, entities tg.Entities, msg *tg.Message, withReply bool) (urls []string) {
+	msgURLs := getMsgURLs(msg)
+	if replyToMsgID := getReplyToMsgID(msg); withReply && len(msgURLs) == 0 && replyToMsgID != 0 {
+		fromUser, fromGroup := resolveMsgSrc(msg)
+		replyToMsg, err := getMessage(ctx, getInputPeer(entities, fromUser, fromGroup), replyToMsgID)
+		if err != nil {
+			fmt.Println("  error getting replied message:", err)
+		} else {
+			fmt.Println("  using urls of replied message")
+			msgURLs = getMsgURLs(replyToMsg)
+		}
+	}
+
+	for _, u := range msgURLs {
+		if !isValidURL(u) {
+			fmt.Println("  (invalid url:", u+")")
+			continue
+		}
+		if len(urls) == maxMsgURLs {
+			fmt.Println("  (too many urls, ignoring the rest)")
+			break
+		}
+		urls = append(urls, u)
+	}
+	return
+}
+
+func handleCmdDLP(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, msg *tg.Message) {
 	format := "video"
-	s := strings.Split(msg.Message, " ")
-	if len(s) >= 2 && s[0] == "mp3" {
-		msg.Message = strings.Join(s[1:], " ")
-		format = "mp3"
+	args := strings.Fields(msg.Message)
+	if len(args) > 0 && isValidFormat(args[0]) {
+		format = args[0]
+		args = args[1:]
 	}
 
-	// Check if message is an URL.
-	validURI := true
-	uri, err := url.ParseRequestURI(msg.Message)
-	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") {
-		validURI = false
-	} else {
-		_, err = net.LookupHost(uri.Host)
+	// The URL entities refer to the original message text, with the command.
+	origMsg, _ := u.GetMessage().(*tg.Message)
+	urlTexts := getMsgURLEntityTexts(origMsg)
+
+	// An optional playlist item range, clip range, audio bitrate or subtitle languages can be given after the URLs.
+	// Playlist item ranges only have numbers (like 3-10), clip ranges have minutes (like 1:30-2:00). The first
+	// argument which is not an option starts a comment, the rest of the message is ignored.
+	var quality string
+	var playlistStart, playlistEnd int
+	var clipStart, clipEnd float64
+	var subMode string
+	var subLangs []string
+args:
+	for _, arg := range args {
+		if slices.ContainsFunc(urlTexts, func(t string) bool { return strings.Contains(arg, t) }) {
+			continue
+		}
+		var err error
+		switch {
+		case strings.Trim(arg, "0123456789-") == "" && strings.Contains(arg, "-"):
+			playlistStart, playlistEnd, err = parsePlaylistRange(arg)
+		case strings.Trim(arg, "0123456789-:.") == "" && strings.Contains(arg, "-") && strings.Contains(arg, ":"):
+			clipStart, clipEnd, err = parseClipRange(arg)
+		case strings.Trim(arg, "0123456789") == "k" && isLossyAudioFormat(format):
+			if parseAudioBitrate(arg) == 0 {
+				err = fmt.Errorf("invalid bitrate, it should be between %dk and %dk", minAudioBitrate, maxAudioBitrate)
+			}
+			quality = arg
+		default:
+			mode, langs, ok, subErr := parseSubtitlesArg(arg)
+			if !ok {
+				break args
+			}
+			subMode, subLangs, err = mode, langs, subErr
+		}
 		if err != nil {
-			validURI = false
+			fmt.Println("  (invalid arg)")
+			_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": "+err.Error())
+			return
 		}
 	}
-	if !validURI {
-		fmt.Println("  (not an url)")
+	if isAudioFormat(format) && (subMode == subtitleModeEmbed || subMode == subtitleModeBurn) {
+		fmt.Println("  (audio with subtitles)")
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": subtitles can only be sent as .srt files with audio formats, use "+subtitleModeSRT)
+		return
+	}
+	if isGIFFormat(format) && subMode != "" && subMode != subtitleModeBurn {
+		fmt.Println("  (gif with subtitles)")
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": subtitles can only be burned into animations, use "+subtitleModeBurn)
+		return
+	}
+	if playlistStart > 0 && clipEnd > 0 {
+		fmt.Println("  (playlist range with clip range)")
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": a clip range can't be used with a playlist item range")
+		return
+	}
+
+	// Only an explicit /dlp command downloads the URLs of the replied message, not every reply in a private chat.
+	urls := getRequestURLs(ctx, entities, origMsg, isCmdMsg(origMsg))
+	if len(urls) == 0 {
+		fmt.Println("  (no url)")
 		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": please enter an URL to download")
 		return
 	}
+	if playlistStart > 0 && len(urls) > 1 {
+		fmt.Println("  (playlist range with multiple urls)")
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": a playlist item range can only be used with one URL")
+		return
+	}
+
+	for _, reqURL := range urls {
+		qEntry := &DownloadQueueEntry{
+			URL:           reqURL,
+			Format:        format,
+			Quality:       quality,
+			PlaylistStart: playlistStart,
+			PlaylistEnd:   playlistEnd,
+			ClipStart:     clipStart,
+			ClipEnd:       clipEnd,
+			SubLangs:      subLangs,
+			SubMode:       subMode,
+		}
+		if len(urls) == 1 && format == "video" && playlistStart == 0 && params.FormatPickerTimeout > 0 {
+			formatPicker.Start(ctx, entities, u, qEntry)
+			return
+		}
+		dlQueue.Add(ctx, entities, u, qEntry)
+	}
+}
+
+func handleCmdDLPCancel(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, msg *tg.Message) {
+	fromUser, fromGroup := resolveMsgSrc(msg)
+	if err := dlQueue.Cancel(ctx, fromUser, fromGroup, msg.Message); err != nil {
+		fmt.Println("  cancel error:", err)
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": "+err.Error())
+	}
+}
+
+func handleCmdDLPCaption(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, msg *tg.Message) {
+	fromUser, fromGroup := resolveMsgSrc(msg)
+	chatID := getChatID(fromUser, fromGroup)
+	arg := strings.TrimSpace(msg.Message)
+	if arg != "" && !slices.Contains(params.AdminUserIDs, fromUser.UserID) {
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": only admins can set the caption template")
+		return
+	}
+
+	var err error
+	var replyStr string
+	switch arg {
+	case "":
+		tmpl := getCaptionTemplate(chatID)
+		if tmpl == "" {
+			tmpl = captionOffStr
+		}
+		replyStr = "📝 Current caption template:\n" + tmpl + "\n\nAvailable fields: {{.Title}}, {{.Uploader}}, {{.URL}}, " +
+			"{{.Duration}}, {{.Resolution}}, {{.Size}}, {{.Username}}"
+	case "reset":
+		err = store.DeleteCaptionTemplate(chatID)
+		replyStr = "📝 Caption template reset to default"
+	case captionOffStr:
+		err = store.PutCaptionTemplate(chatID, "")
+		replyStr = "📝 Captions disabled"
+	default:
+		if err = validateCaptionTemplate(arg); err == nil {
+			err = store.PutCaptionTemplate(chatID, arg)
+		}
+		replyStr = "📝 Caption template set"
+	}
+	if err != nil {
+		fmt.Println("  caption template error:", err)
+		replyStr = errorStr + ": " + err.Error()
+	}
+	_, _ = telegramSender.Reply(entities, u).Text(ctx, replyStr)
+}
+
+func handleCmdDLPAuto(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, msg *tg.Message) {
+	fromUser, fromGroup := resolveMsgSrc(msg)
+	if fromGroup == nil {
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": automatic URL detection can only be set in groups, "+
+			"URLs sent in private chats are always downloaded")
+		return
+	}
+	chatID := getChatID(fromUser, fromGroup)
+	args := strings.Fields(msg.Message)
+	if len(args) > 0 && !slices.Contains(params.AdminUserIDs, fromUser.UserID) {
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": only admins can change automatic URL detection")
+		return
+	}
 
-	dlQueue.Add(ctx, entities, u, msg.Message, format)
+	settings := getAutoDownloadSettings(chatID)
+	if len(args) > 0 {
+		switch {
+		case args[0] == "on":
+			if len(settings.Domains) == 0 {
+				_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": add the allowed domains first, like "+
+					"/dlpauto add tiktok.com")
+				return
+			}
+			settings.Enabled = true
+		case args[0] == "off":
+			settings.Enabled = false
+		case args[0] == "add" && len(args) > 1:
+			settings.addDomains(args[1:])
+		case args[0] == "del" && len(args) > 1:
+			settings.removeDomains(args[1:])
+		case args[0] == "clear":
+			// No domains are allowed without the allowlist.
+			settings.Domains = nil
+			settings.Enabled = false
+		default:
+			_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": invalid argument, use on, off, add <domains>, "+
+				"del <domains> or clear")
+			return
+		}
+		if err := store.PutAutoDownloadSettings(chatID, settings); err != nil {
+			fmt.Println("  auto download settings error:", err)
+			_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": "+err.Error())
+			return
+		}
+	}
+	_, _ = telegramSender.Reply(entities, u).Text(ctx, settings.String())
 }
 
-func handleCmdDLPCancel(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage, msg *tg.Message) {
-	dlQueue.CancelCurrentEntry(ctx, entities, u, msg.Message)
+// Downloads the URLs of the given group message if automatic URL detection is enabled in the group.
+func handleAutoDownload(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, msg *tg.Message) {
+	fromUser, fromGroup := resolveMsgSrc(msg)
+	settings := getAutoDownloadSettings(getChatID(fromUser, fromGroup))
+	if !settings.Enabled {
+		return
+	}
+
+	for _, msgURL := range getRequestURLs(ctx, entities, msg, false) {
+		if !settings.isAllowedURL(msgURL) {
+			fmt.Println("  (domain not allowed, ignoring", msgURL+")")
+			continue
+		}
+		fmt.Println("  auto downloading", msgURL)
+		dlQueue.Add(ctx, entities, u, &DownloadQueueEntry{
+			URL:    msgURL,
+			Format: "video",
+		})
+	}
+}
+
+func handleCmdQueue(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, msg *tg.Message) {
+	fromUser, fromGroup := resolveMsgSrc(msg)
+	isAdmin := slices.Contains(params.AdminUserIDs, fromUser.UserID)
+	_, _ = telegramSender.Reply(entities, u).Text(ctx, dlQueue.GetListStr(fromUser, fromGroup, isAdmin))
 }
 
-func handleMsg(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage) error {
-	msg, ok := u.Message.(*tg.Message)
+// Downloads the media of the URL in the given channel post, and posts it to the channel.
+func handleChannelPost(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, msg *tg.Message) {
+	postURL := getMsgURL(msg)
+	if postURL == "" {
+		fmt.Println("  (no url in post)")
+		return
+	}
+	fmt.Println("  reposting", postURL)
+
+	dlQueue.Add(ctx, entities, u, &DownloadQueueEntry{
+		URL:    postURL,
+		Format: "video",
+		Repost: true,
+	})
+}
+
+func handleCallbackQuery(ctx context.Context, entities tg.Entities, u *tg.UpdateBotCallbackQuery) error {
+	data := string(u.Data)
+	fmt.Println("got callback query from #", u.UserID, ":", data)
+
+	answer := &tg.MessagesSetBotCallbackAnswerRequest{
+		QueryID: u.QueryID,
+	}
+
+	switch {
+	case strings.HasPrefix(data, cancelCallbackDataPrefix):
+		fromUser := &tg.PeerUser{UserID: u.UserID}
+		var fromGroup tg.PeerClass
+		if _, ok := u.Peer.(*tg.PeerUser); !ok {
+			fromGroup = u.Peer
+		}
+		if err := dlQueue.Cancel(ctx, fromUser, fromGroup, "#"+strings.TrimPrefix(data, cancelCallbackDataPrefix)); err != nil {
+			fmt.Println("  cancel error:", err)
+			answer.Message = errorStr + ": " + err.Error()
+			answer.Alert = true
+		}
+	case strings.HasPrefix(data, formatPickerCallbackDataPrefix):
+		if err := formatPicker.HandleChoice(u.UserID, data); err != nil {
+			fmt.Println("  format choice error:", err)
+			answer.Message = errorStr + ": " + err.Error()
+			answer.Alert = true
+		}
+	default:
+		fmt.Println("  (invalid callback query)")
+	}
+
+	_, _ = telegramAPI.MessagesSetBotCallbackAnswer(ctx, answer)
+	return nil
+}
+
+func handleMsg(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate) error {
+	msg, ok := u.GetMessage().(*tg.Message)
 	if !ok || msg.Out {
 		// Outgoing message, not interesting.
 		return nil
 	}
+	if msg.Message == "" {
+		// Media without text, not interesting.
+		return nil
+	}
 
 	fromUser, fromGroup := resolveMsgSrc(msg)
 	fromUsername := getFromUsername(entities, fromUser.UserID)
@@ -71,9 +357,20 @@ func handleMsg(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage
 	}
 	fmt.Println(":", msg.Message)
 
+	if msg.Post {
+		fmt.Print("  post in channel #", getGroupID(fromGroup))
+		if !slices.Contains(params.RepostChannelIDs, getGroupID(fromGroup)) {
+			fmt.Println(", channel not set for reposting, ignoring")
+			return nil
+		}
+		fmt.Println()
+		handleChannelPost(ctx, entities, u, msg)
+		return nil
+	}
+
 	if fromGroup != nil {
-		fmt.Print("  msg from group #", -fromGroup.ChatID)
-		if !slices.Contains(params.AllowedGroupIDs, -fromGroup.ChatID) {
+		fmt.Print("  msg from group #", getGroupID(fromGroup))
+		if !slices.Contains(params.AllowedGroupIDs, getGroupID(fromGroup)) {
 			fmt.Println(", group not allowed, ignoring")
 			return nil
 		}
@@ -86,9 +383,13 @@ func handleMsg(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage
 	}
 
 	// Check if message is a command.
-	if msg.Message[0] == '/' || msg.Message[0] == '!' {
+	if isCmdMsg(msg) {
 		cmd := strings.Split(msg.Message, " ")[0]
-		msg.Message = strings.TrimPrefix(msg.Message, cmd+" ")
+		// The command handlers get the command's arguments as the message text, the update keeps the original
+		// message, as the entity offsets refer to its text.
+		argsMsg := *msg
+		argsMsg.Message = strings.TrimPrefix(strings.TrimPrefix(msg.Message, cmd), " ")
+		msg = &argsMsg
 		if strings.Contains(cmd, "@") {
 			cmd = strings.Split(cmd, "@")[0]
 		}
@@ -100,6 +401,15 @@ func handleMsg(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage
 		case "dlpcancel":
 			handleCmdDLPCancel(ctx, entities, u, msg)
 			return nil
+		case "dlpcaption":
+			handleCmdDLPCaption(ctx, entities, u, msg)
+			return nil
+		case "dlpauto":
+			handleCmdDLPAuto(ctx, entities, u, msg)
+			return nil
+		case "queue":
+			handleCmdQueue(ctx, entities, u, msg)
+			return nil
 		case "start":
 			fmt.Println("  (start cmd)")
 			if fromGroup == nil {
@@ -119,6 +429,8 @@ func handleMsg(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage
 
 	if fromGroup == nil {
 		handleCmdDLP(ctx, entities, u, msg)
+	} else {
+		handleAutoDownload(ctx, entities, u, msg)
 	}
 	return nil
 }
@@ -131,6 +443,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := store.Init(params.DBPath); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
 	// Dispatcher handles incoming updates.
 	dispatcher := tg.NewUpdateDispatcher()
 	opts := telegram.Options{
@@ -157,10 +474,10 @@ func main() {
 			}
 		}
 
-		api := client.API()
+		telegramAPI = client.API()
 
-		telegramUploader = uploader.NewUploader(api).WithProgress(dlUploader)
-		telegramSender = message.NewSender(api).WithUploader(telegramUploader)
+		telegramUploader = uploader.NewUploader(telegramAPI)
+		telegramSender = message.NewSender(telegramAPI).WithUploader(telegramUploader)
 
 		goutubedl.Path, err = exec.LookPath(goutubedl.Path)
 		if err != nil {
@@ -172,7 +489,14 @@ func main() {
 
 		dlQueue.Init(ctx)
 
-		dispatcher.OnNewMessage(handleMsg)
+		dispatcher.OnNewMessage(func(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage) error {
+			return handleMsg(ctx, entities, u)
+		})
+		// Supergroup and channel messages.
+		dispatcher.OnNewChannelMessage(func(ctx context.Context, entities tg.Entities, u *tg.UpdateNewChannelMessage) error {
+			return handleMsg(ctx, entities, u)
+		})
+		dispatcher.OnBotCallbackQuery(handleCallbackQuery)
 
 		fmt.Println("telegram connection up")
 
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"golang.org/x/exp/slices"
+)
+
+const cachedStr = "🏁 Sent from cache"
+
+// Query params which don't change the content of the page, so they are removed from the cache keys.
+var mediaCacheIgnoredQueryParams = []string{"si", "feature", "fbclid", "gclid", "igshid", "igsh", "ref_src", "t"}
+
+// cachedDocument is an uploaded Telegram document, which can be sent again without uploading it, along with the
+// info needed for rendering its caption.
+type cachedDocument struct {
+	ID            int64  `json:"id"`
+	AccessHash    int64  `json:"access_hash"`
+	FileReference []byte `json:"file_reference"`
+	// ID of the message which contains the document, used for refreshing the file reference. If the message is in
+	// a supergroup or channel, then its ID is only valid with the channel.
+	MsgID             int   `json:"msg_id"`
+	ChannelID         int64 `json:"channel_id,omitempty"`
+	ChannelAccessHash int64 `json:"channel_access_hash,omitempty"`
+
+	Title    string  `json:"title"`
+	Uploader string  `json:"uploader"`
+	Duration float64 `json:"duration"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Size     int64   `json:"size"`
+	// Set for .srt subtitle documents, which are sent without a caption.
+	Subtitle bool `json:"subtitle,omitempty"`
+	// Set for video notes, which can't have a caption.
+	Round bool `json:"round,omitempty"`
+}
+
+// Returns the given URL in a form which is the same for URLs pointing to the same media.
+func normalizeURL(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+
+	u.Scheme = "https"
+	u.Host = strings.ToLower(u.Host)
+	u.Host = strings.TrimPrefix(u.Host, "www.")
+	u.Host = strings.TrimPrefix(u.Host, "m.")
+	u.Fragment = ""
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	q := u.Query()
+	switch {
+	case u.Host == "youtu.be" && u.Path != "":
+		q.Set("v", strings.TrimPrefix(u.Path, "/"))
+		u.Host = "youtube.com"
+		u.Path = "/watch"
+	case u.Host == "youtube.com" && strings.HasPrefix(u.Path, "/shorts/"):
+		q.Set("v", strings.TrimPrefix(u.Path, "/shorts/"))
+		u.Path = "/watch"
+	}
+	for k := range q {
+		if strings.HasPrefix(k, "utm_") || slices.Contains(mediaCacheIgnoredQueryParams, k) {
+			q.Del(k)
+		}
+	}
+
+	// Encode() sorts the params by key.
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func getMediaCacheKey(qEntry *DownloadQueueEntry) string {
+	quality := qEntry.Quality
+	if quality == "" && !isAudioFormat(qEntry.Format) {
+		quality = params.DefaultQuality
+	}
+	key := fmt.Sprint(normalizeURL(qEntry.URL), "|", qEntry.Format, "|", quality, "|", qEntry.PlaylistIndex)
+	if qEntry.ClipEnd > 0 {
+		key += fmt.Sprint("|", qEntry.ClipStart, "-", qEntry.ClipEnd)
+	}
+	if len(qEntry.SubLangs) > 0 {
+		key += "|" + qEntry.SubMode + ":" + strings.Join(qEntry.SubLangs, ",")
+	}
+	return key
+}
+
+// Returns the document and its message ID from the given updates of a sent media message.
+func getSentDocument(upd tg.UpdatesClass) (doc *tg.Document, msgID int) {
+	var msgs []tg.MessageClass
+	switch u := upd.(type) {
+	case *tg.Updates:
+		for _, update := range u.Updates {
+			switch m := update.(type) {
+			case *tg.UpdateNewMessage:
+				msgs = append(msgs, m.Message)
+			case *tg.UpdateNewChannelMessage:
+				msgs = append(msgs, m.Message)
+			}
+		}
+	case *tg.UpdateShortSentMessage:
+		if media, ok := u.Media.(*tg.MessageMediaDocument); ok {
+			doc, _ = media.Document.(*tg.Document)
+			return doc, u.ID
+		}
+	}
+	return getDocumentFromMessages(msgs, 0)
+}
+
+// Returns the first document found in the given messages. If docID is set, then only the document with the
+// given ID is returned.
+func getDocumentFromMessages(msgs []tg.MessageClass, docID int64) (doc *tg.Document, msgID int) {
+	for _, m := range msgs {
+		msg, ok := m.(*tg.Message)
+		if !ok {
+			continue
+		}
+		media, ok := msg.Media.(*tg.MessageMediaDocument)
+		if !ok {
+			continue
+		}
+		doc, ok := media.Document.(*tg.Document)
+		if ok && (docID == 0 || doc.ID == docID) {
+			return doc, msg.ID
+		}
+	}
+	return nil, 0
+}
+
+// Gets a new file reference for the given document from the message which contains it.
+func refreshFileReference(ctx context.Context, cDoc *cachedDocument) error {
+	var peer tg.InputPeerClass
+	if cDoc.ChannelID != 0 {
+		peer = &tg.InputPeerChannel{ChannelID: cDoc.ChannelID, AccessHash: cDoc.ChannelAccessHash}
+	}
+	msg, err := getMessage(ctx, peer, cDoc.MsgID)
+	if err != nil {
+		return err
+	}
+	doc, _ := getDocumentFromMessages([]tg.MessageClass{msg}, cDoc.ID)
+	if doc == nil {
+		return fmt.Errorf("document not found")
+	}
+	cDoc.FileReference = doc.FileReference
+	return nil
+}
+
+func sendCachedDocument(ctx context.Context, qEntry *DownloadQueueEntry, cDoc *cachedDocument) error {
+	var caption []message.StyledTextOption
+	var err error
+	if !cDoc.Subtitle && !cDoc.Round {
+		caption, err = renderCaption(getCaptionTemplate(getChatID(qEntry.FromUser, qEntry.FromGroup)), newCaptionData(qEntry, *cDoc))
+		if err != nil {
+			fmt.Println("  error rendering caption:", err)
+		}
+	}
+
+	replyToMsgID := qEntry.OrigMsgID
+	if qEntry.Repost && params.RepostMode == repostModeReplace {
+		// The original post gets deleted.
+		replyToMsgID = 0
+	}
+	send := func() error {
+		doc := &tg.InputDocument{ID: cDoc.ID, AccessHash: cDoc.AccessHash, FileReference: cDoc.FileReference}
+		_, err := telegramSender.To(qEntry.Peer).Reply(replyToMsgID).Media(ctx, message.Document(doc, caption...))
+		return err
+	}
+
+	err = send()
+	if tgerr.Is(err, "FILE_REFERENCE_EXPIRED") {
+		fmt.Println("  refreshing file reference")
+		if err := refreshFileReference(ctx, cDoc); err != nil {
+			return fmt.Errorf("refreshing file reference: %w", err)
+		}
+		err = send()
+	}
+	return err
+}
+
+// Sends the cached documents of the given entry if there are any. Returns false if the entry is not cached, or the
+// cached documents can't be sent anymore, so the entry should be downloaded.
+func sendCachedMedia(ctx context.Context, qEntry *DownloadQueueEntry) bool {
+	// Playlist items are sent as albums, so they are not cached.
+	if qEntry.album != nil || qEntry.PlaylistStart > 0 {
+		return false
+	}
+
+	key := getMediaCacheKey(qEntry)
+	cDocs, found, err := store.GetCachedDocuments(key)
+	if err != nil {
+		fmt.Println("  error getting cached documents:", err)
+		return false
+	}
+	if !found {
+		return false
+	}
+
+	fmt.Println("  sending", len(cDocs), "cached documents")
+	for i := range cDocs {
+		if err := sendCachedDocument(ctx, qEntry, &cDocs[i]); err != nil {
+			fmt.Println("  error sending cached document, downloading again:", err)
+			if err := store.DeleteCachedDocuments(key); err != nil {
+				fmt.Println("  error deleting cached documents:", err)
+			}
+			return false
+		}
+	}
+
+	// Storing the refreshed file references.
+	if err := store.PutCachedDocuments(key, cDocs); err != nil {
+		fmt.Println("  error storing cached documents:", err)
+	}
+
+	if qEntry.ReplyMsgID != 0 {
+		qEntry.finished = true
+		qEntry.editReply(ctx, cachedStr)
+	}
+	deleteRepostedPost(ctx, qEntry)
+	return true
+}
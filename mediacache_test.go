@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://www.youtube.com/watch?v=abc", want: "https://youtube.com/watch?v=abc"},
+		{url: "http://m.youtube.com/watch?v=abc&feature=share", want: "https://youtube.com/watch?v=abc"},
+		{url: "https://youtu.be/abc?si=xyz", want: "https://youtube.com/watch?v=abc"},
+		{url: "https://youtu.be/abc?t=42", want: "https://youtube.com/watch?v=abc"},
+		{url: "https://www.youtube.com/shorts/abc", want: "https://youtube.com/watch?v=abc"},
+		{url: "https://YouTube.com/watch?list=pl&v=abc", want: "https://youtube.com/watch?list=pl&v=abc"},
+		{url: "https://x.com/user/status/1/", want: "https://x.com/user/status/1"},
+		{url: "https://x.com/user/status/1#frag", want: "https://x.com/user/status/1"},
+		{url: "https://example.com/v?utm_source=a&utm_medium=b&id=3", want: "https://example.com/v?id=3"},
+		{url: "  https://example.com/v  ", want: "https://example.com/v"},
+		// Only the youtu.be short links are rewritten.
+		{url: "https://youtu.be", want: "https://youtu.be"},
+		{url: "not an url", want: "not an url"},
+	}
+	for _, tt := range tests {
+		if got := normalizeURL(tt.url); got != tt.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
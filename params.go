@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/wader/goutubedl"
@@ -21,7 +22,21 @@ type paramsType struct {
 	AdminUserIDs    []int64
 	AllowedGroupIDs []int64
 
-	MaxSize int64
+	RepostChannelIDs []int64
+	RepostMode       string
+
+	MaxSize        int64
+	OversizeMode   string
+	Workers        int
+	ConvertTimeout time.Duration
+
+	DBPath string
+
+	DefaultQuality      string
+	FormatPickerTimeout time.Duration
+	MaxPlaylistItems    int
+
+	CaptionTemplate string
 }
 
 var params paramsType
@@ -42,8 +57,23 @@ func (p *paramsType) Init() error {
 	flag.StringVar(&adminUserIDs, "admin-user-ids", "", "admin telegram user ids")
 	var allowedGroupIDs string
 	flag.StringVar(&allowedGroupIDs, "allowed-group-ids", "", "allowed telegram group ids")
+	var repostChannelIDs string
+	flag.StringVar(&repostChannelIDs, "repost-channel-ids", "", "telegram channel ids where the bot reposts the media of posted urls")
+	flag.StringVar(&p.RepostMode, "repost-mode", "", "how media is reposted in channels: reply, or replace to delete the original post (default reply)")
 	var maxSize string
 	flag.StringVar(&maxSize, "max-size", "", "allowed max size of video files")
+	flag.StringVar(&p.OversizeMode, "oversize-mode", "", "what to do with files over the max. size: split, compress or error (default error)")
+	var workers string
+	flag.StringVar(&workers, "workers", "", "number of requests processed in parallel (default 1)")
+	var convertTimeout string
+	flag.StringVar(&convertTimeout, "convert-timeout", "", "max. time of downloading and converting a request, uploading is not limited (default 5m)")
+	flag.StringVar(&p.DefaultQuality, "default-quality", "", "default video quality: best, or max. resolution like 720p (default 720p)")
+	var formatPickerTimeout string
+	flag.StringVar(&formatPickerTimeout, "format-picker-timeout", "", "show a format picker for requests, and choose the default quality after this timeout (like 30s)")
+	var maxPlaylistItems string
+	flag.StringVar(&maxPlaylistItems, "max-playlist-items", "", "max. number of playlist items downloaded for a request (default 10)")
+	flag.StringVar(&p.CaptionTemplate, "caption-template", "", "default caption template of the uploaded media, or off to disable captions")
+	flag.StringVar(&p.DBPath, "db-path", "", "path of the database file used for storing the queue (default yt-dlp-telegram-bot.db)")
 	flag.Parse()
 
 	var err error
@@ -127,6 +157,31 @@ func (p *paramsType) Init() error {
 		p.AllowedGroupIDs = append(p.AllowedGroupIDs, id)
 	}
 
+	if repostChannelIDs == "" {
+		repostChannelIDs = os.Getenv("REPOST_CHANNELIDS")
+	}
+	sa = strings.Split(repostChannelIDs, ",")
+	for _, idStr := range sa {
+		if idStr == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("repost channel ids contains invalid channel ID: " + idStr)
+		}
+		p.RepostChannelIDs = append(p.RepostChannelIDs, id)
+	}
+
+	if p.RepostMode == "" {
+		p.RepostMode = os.Getenv("REPOST_MODE")
+	}
+	if p.RepostMode == "" {
+		p.RepostMode = repostModeReply
+	}
+	if !slices.Contains([]string{repostModeReply, repostModeReplace}, p.RepostMode) {
+		return fmt.Errorf("invalid repost mode: %s", p.RepostMode)
+	}
+
 	if maxSize == "" {
 		maxSize = os.Getenv("MAX_SIZE")
 	}
@@ -138,6 +193,89 @@ func (p *paramsType) Init() error {
 		p.MaxSize = b.Int64()
 	}
 
+	if p.OversizeMode == "" {
+		p.OversizeMode = os.Getenv("OVERSIZE_MODE")
+	}
+	if p.OversizeMode == "" {
+		p.OversizeMode = oversizeModeError
+	}
+	if !slices.Contains([]string{oversizeModeSplit, oversizeModeCompress, oversizeModeError}, p.OversizeMode) {
+		return fmt.Errorf("invalid oversize mode: %s", p.OversizeMode)
+	}
+
+	if workers == "" {
+		workers = os.Getenv("WORKERS")
+	}
+	p.Workers = 1
+	if workers != "" {
+		p.Workers, err = strconv.Atoi(workers)
+		if err != nil || p.Workers < 1 {
+			return fmt.Errorf("invalid workers count")
+		}
+	}
+
+	if convertTimeout == "" {
+		convertTimeout = os.Getenv("CONVERT_TIMEOUT")
+	}
+	p.ConvertTimeout = 5 * time.Minute
+	if convertTimeout != "" {
+		p.ConvertTimeout, err = time.ParseDuration(convertTimeout)
+		if err != nil || p.ConvertTimeout <= 0 {
+			return fmt.Errorf("invalid convert timeout")
+		}
+	}
+
+	if p.DefaultQuality == "" {
+		p.DefaultQuality = os.Getenv("DEFAULT_QUALITY")
+	}
+	if p.DefaultQuality == "" {
+		p.DefaultQuality = "720p"
+	}
+	if !isValidQuality(p.DefaultQuality) {
+		return fmt.Errorf("invalid default quality: %s", p.DefaultQuality)
+	}
+
+	if formatPickerTimeout == "" {
+		formatPickerTimeout = os.Getenv("FORMAT_PICKER_TIMEOUT")
+	}
+	if formatPickerTimeout != "" {
+		p.FormatPickerTimeout, err = time.ParseDuration(formatPickerTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid format picker timeout: %w", err)
+		}
+	}
+
+	if maxPlaylistItems == "" {
+		maxPlaylistItems = os.Getenv("MAX_PLAYLIST_ITEMS")
+	}
+	p.MaxPlaylistItems = 10
+	if maxPlaylistItems != "" {
+		p.MaxPlaylistItems, err = strconv.Atoi(maxPlaylistItems)
+		if err != nil || p.MaxPlaylistItems < 1 {
+			return fmt.Errorf("invalid max playlist items")
+		}
+	}
+
+	if p.CaptionTemplate == "" {
+		p.CaptionTemplate = os.Getenv("CAPTION_TEMPLATE")
+	}
+	switch p.CaptionTemplate {
+	case "":
+		p.CaptionTemplate = defaultCaptionTemplate
+	case captionOffStr:
+		p.CaptionTemplate = ""
+	}
+	if err := validateCaptionTemplate(p.CaptionTemplate); err != nil {
+		return err
+	}
+
+	if p.DBPath == "" {
+		p.DBPath = os.Getenv("DB_PATH")
+	}
+	if p.DBPath == "" {
+		p.DBPath = "yt-dlp-telegram-bot.db"
+	}
+
 	// Writing env. var YTDLP_COOKIES contents to a file.
 	// In case a docker container is used, the yt-dlp.conf points yt-dlp to this cookie file.
 	if cookies := os.Getenv("YTDLP_COOKIES"); cookies != "" {
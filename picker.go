@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/message/markup"
+	"github.com/gotd/td/tg"
+	"github.com/wader/goutubedl"
+	"golang.org/x/exp/slices"
+)
+
+const formatPickerProbeStr = "🔍 Getting available formats..."
+const formatPickerStr = "🎞 Choose format"
+
+const formatPickerCallbackDataPrefix = "dlpfmt:"
+const formatPickerProbeTimeout = time.Minute
+const formatPickerMaxResolutions = 6
+const formatPickerButtonsPerRow = 2
+
+// Audio only is not a quality, it's handled as the mp3 format.
+const formatPickerAudioOption = "audio"
+
+type formatPickerOption struct {
+	Quality string
+	Label   string
+}
+
+type formatPickerEntry struct {
+	fromUser   *tg.PeerUser
+	choiceChan chan string
+}
+
+type FormatPicker struct {
+	mutex   sync.Mutex
+	entries map[int64]*formatPickerEntry
+	lastID  int64
+}
+
+var formatPicker FormatPicker
+
+// Returns the estimated size of the given format in bytes, or 0 if it's unknown.
+func getFormatSize(f goutubedl.Format, duration float64) float64 {
+	if f.Filesize > 0 {
+		return f.Filesize
+	}
+	if f.FilesizeApprox > 0 {
+		return f.FilesizeApprox
+	}
+	return f.TBR * 1000 / 8 * duration
+}
+
+func getFormatPickerOptions(info goutubedl.Info) (options []formatPickerOption) {
+	// Video only formats get merged with the best audio stream.
+	var bestAudioSize float64
+	for _, f := range info.Formats {
+		if f.VCodec == "none" && f.ACodec != "none" {
+			bestAudioSize = max(bestAudioSize, getFormatSize(f, info.Duration))
+		}
+	}
+
+	sizes := make(map[int]float64)
+	for _, f := range info.Formats {
+		if f.VCodec == "none" || f.Height <= 0 {
+			continue
+		}
+		size := getFormatSize(f, info.Duration)
+		if size > 0 && f.ACodec == "none" {
+			size += bestAudioSize
+		}
+		sizes[int(f.Height)] = max(sizes[int(f.Height)], size)
+	}
+
+	var heights []int
+	for h := range sizes {
+		heights = append(heights, h)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(heights)))
+	if len(heights) > formatPickerMaxResolutions {
+		heights = heights[:formatPickerMaxResolutions]
+	}
+
+	for _, h := range heights {
+		o := formatPickerOption{
+			Quality: fmt.Sprint(h, "p"),
+			Label:   fmt.Sprint("🎬 ", h, "p"),
+		}
+		if sizes[h] > 0 {
+			o.Label += " (~" + humanize.BigBytes(big.NewInt(int64(sizes[h]))) + ")"
+		}
+		options = append(options, o)
+	}
+
+	audioLabel := "🎵 Audio only"
+	if bestAudioSize > 0 {
+		audioLabel += " (~" + humanize.BigBytes(big.NewInt(int64(bestAudioSize))) + ")"
+	}
+	options = append(options, formatPickerOption{Quality: formatPickerAudioOption, Label: audioLabel})
+	options = append(options, formatPickerOption{Quality: "best", Label: "⭐ Original (best)"})
+	return
+}
+
+func (p *FormatPicker) getMarkup(id int64, options []formatPickerOption) tg.ReplyMarkupClass {
+	var rows []tg.KeyboardButtonRow
+	var buttons []tg.KeyboardButtonClass
+	for _, o := range options {
+		data := []byte(fmt.Sprint(formatPickerCallbackDataPrefix, id, ":", o.Quality))
+		buttons = append(buttons, markup.Callback(o.Label, data))
+		if len(buttons) == formatPickerButtonsPerRow {
+			rows = append(rows, markup.Row(buttons...))
+			buttons = nil
+		}
+	}
+	if len(buttons) > 0 {
+		rows = append(rows, markup.Row(buttons...))
+	}
+	return markup.InlineKeyboard(rows...)
+}
+
+// Start replies with a format picker to the given message, then adds the given request entry to the download
+// queue with the chosen format. If nothing gets chosen until the format picker timeout, the default quality is used.
+func (p *FormatPicker) Start(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, qEntry *DownloadQueueEntry) {
+	msg := u.GetMessage().(*tg.Message)
+	fromUser, fromGroup := resolveMsgSrc(msg)
+	peer := getInputPeer(entities, fromUser, fromGroup)
+
+	replyUpd, err := telegramSender.Reply(entities, u).Text(ctx, formatPickerProbeStr)
+	if err != nil {
+		fmt.Println("  error sending reply:", err)
+		return
+	}
+	replyMsgID, err := getSentMsgID(replyUpd)
+	if err != nil {
+		fmt.Println("  error getting reply message id:", err)
+		return
+	}
+
+	p.mutex.Lock()
+	if p.entries == nil {
+		p.entries = make(map[int64]*formatPickerEntry)
+	}
+	p.lastID++
+	id := p.lastID
+	pEntry := &formatPickerEntry{
+		fromUser:   fromUser,
+		choiceChan: make(chan string, 1),
+	}
+	p.entries[id] = pEntry
+	p.mutex.Unlock()
+
+	// The update handler's context can't be used after the handler returns.
+	ctx = dlQueue.ctx
+
+	go func() {
+		defer func() {
+			p.mutex.Lock()
+			delete(p.entries, id)
+			p.mutex.Unlock()
+		}()
+
+		probeCtx, probeCtxCancel := context.WithTimeout(ctx, formatPickerProbeTimeout)
+		result, err := goutubedl.New(probeCtx, qEntry.URL, goutubedl.Options{
+			Type:     goutubedl.TypeSingle,
+			DebugLog: goYouTubeDLLogger{},
+		})
+		probeCtxCancel()
+		if errors.Is(err, goutubedl.ErrNotASingleEntry) {
+			// Playlist items are expanded by the queue, and they are downloaded in the default quality.
+			fmt.Println("  got playlist, skipping format picker")
+			qEntry.ReplyMsgID = replyMsgID
+			dlQueue.Add(ctx, entities, u, qEntry)
+			return
+		}
+		if err != nil {
+			fmt.Println("  error getting formats:", err)
+			_, _ = telegramSender.To(peer).Edit(replyMsgID).Text(ctx, fmt.Sprint(errorStr+": ", err))
+			return
+		}
+
+		options := getFormatPickerOptions(result.Info)
+		pickerStr := fmt.Sprint(formatPickerStr, " (", params.DefaultQuality, " is selected in ",
+			params.FormatPickerTimeout, "):\n", result.Info.Title)
+		_, _ = telegramSender.To(peer).Markup(p.getMarkup(id, options)).Edit(replyMsgID).Text(ctx, pickerStr)
+
+		quality := ""
+		select {
+		case quality = <-pEntry.choiceChan:
+			fmt.Println("  format chosen:", quality)
+		case <-time.After(params.FormatPickerTimeout):
+			fmt.Println("  no format chosen, using default quality")
+		case <-ctx.Done():
+			return
+		}
+
+		qEntry.Quality = quality
+		qEntry.ReplyMsgID = replyMsgID
+		if quality == formatPickerAudioOption {
+			qEntry.Format = "mp3"
+			qEntry.Quality = ""
+		}
+		dlQueue.Add(ctx, entities, u, qEntry)
+	}()
+}
+
+// HandleChoice handles the format picker button callback data. Only the requester or an admin can choose.
+func (p *FormatPicker) HandleChoice(fromUserID int64, data string) error {
+	idStr, quality, _ := strings.Cut(strings.TrimPrefix(data, formatPickerCallbackDataPrefix), ":")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid format picker id")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pEntry, ok := p.entries[id]
+	if !ok {
+		return fmt.Errorf("format picker expired")
+	}
+	if pEntry.fromUser.UserID != fromUserID && !slices.Contains(params.AdminUserIDs, fromUserID) {
+		return fmt.Errorf("only the requester or an admin can choose the format")
+	}
+	if quality != formatPickerAudioOption && !isValidQuality(quality) {
+		return fmt.Errorf("invalid format")
+	}
+
+	select {
+	case pEntry.choiceChan <- quality:
+	default:
+	}
+	return nil
+}
@@ -2,40 +2,100 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/message/markup"
 	"github.com/gotd/td/tg"
+	"golang.org/x/exp/slices"
 )
 
 const processStartStr = "🔍 Getting information..."
 const processStr = "🔨 Processing"
+const compressStr = "🗜 Compressing to fit"
 const uploadStr = "☁️ Uploading"
 const uploadDoneStr = "🏁 Uploading"
 const errorStr = "❌ Error"
 const canceledStr = "❌ Canceled"
+const resumeStr = "🔄 Resuming after restart"
+const playlistStr = "📃 Playlist"
+const attachedStr = "👥 Same media is already being processed, you'll get it too"
+const cancelButtonStr = "❌ Cancel"
+
+const cancelCallbackDataPrefix = "dlpcancel:"
+
+const stageWaitingStr = "⏳ waiting"
+const stageProbingStr = "🔍 probing"
+const stageConvertingStr = "🔨 converting"
+const stageUploadingStr = "☁️ uploading"
 
 const maxProgressPercentUpdateInterval = time.Second
+const maxQueueListMsgLength = 4000
 const progressBarLength = 10
 
 type DownloadQueueEntry struct {
-	URL    string
-	Format string
+	ID      uint64
+	URL     string
+	Format  string
+	Quality string
+
+	// Set for playlist requests. The playlist gets expanded to entries for each playlist item.
+	PlaylistStart int
+	PlaylistEnd   int
+	// Set for playlist items which don't have their own URL, so they can only be downloaded from the playlist.
+	PlaylistIndex int
+
+	// If ClipEnd is set, then only this part of the media is downloaded, in seconds.
+	ClipStart float64
+	ClipEnd   float64
+
+	// If set, then the subtitles of these languages are embedded, burned in or sent as .srt files, depending on
+	// SubMode.
+	SubLangs []string
+	SubMode  string
 
-	OrigEntities  tg.Entities
-	OrigMsgUpdate *tg.UpdateNewMessage
-	OrigMsg       *tg.Message
-	FromUser      *tg.PeerUser
-	FromGroup     *tg.PeerChat
+	Peer         tg.InputPeerClass
+	FromUser     *tg.PeerUser
+	FromGroup    tg.PeerClass
+	FromUsername string
+	OrigMsgID    int
+	// Set for channel posts which get reposted with the downloaded media. No status replies are sent for these.
+	Repost bool
+	// Set if the request came from a forum topic, the replies and uploads are sent to this topic.
+	TopicID    int
+	ReplyMsgID int
+	AddedAt    time.Time
 
-	Reply    *message.Builder
-	ReplyMsg *tg.UpdateShortSentMessage
+	Title string
+	Stage string
 
 	Ctx       context.Context
 	CtxCancel context.CancelFunc
 	Canceled  bool
+	Active    bool
+
+	finished bool
+	// Requesters of the same media who got attached to this entry. They get the progress updates and the uploaded
+	// media too.
+	targets      []*DownloadQueueEntry
+	targetsMutex sync.Mutex
+	// Set for attached entries, this is the entry which does the work.
+	attachedTo *DownloadQueueEntry
+	// Set if the requester canceled, but the entry is still processed for the attached requesters.
+	detached bool
+	// Set when the media got sent, so no more requesters can be attached.
+	sent bool
+
+	album        *playlistAlbum
+	albumMedia   message.MultiMediaOption
+	lastQueuePos int
+	progress     progressStateType
 }
 
 // func (e *DownloadQueueEntry) getTypingActionDst() tg.InputPeerClass {
@@ -57,12 +117,148 @@ func (e *DownloadQueueEntry) sendTypingCancelAction(ctx context.Context) {
 	// _ = telegramSender.To(e.getTypingActionDst()).TypingAction().Cancel(ctx)
 }
 
+func (e *DownloadQueueEntry) getCancelMarkup() tg.ReplyMarkupClass {
+	return markup.InlineRow(markup.Callback(cancelButtonStr, []byte(cancelCallbackDataPrefix+fmt.Sprint(e.ID))))
+}
+
+// Edits the reply message, and the reply messages of the attached entries. The cancel button is shown until the
+// entry is finished.
 func (e *DownloadQueueEntry) editReply(ctx context.Context, s string) {
-	_, _ = e.Reply.Edit(e.ReplyMsg.ID).Text(ctx, s)
-	e.sendTypingAction(ctx)
+	if !e.detached && e.ReplyMsgID != 0 {
+		b := telegramSender.To(e.Peer).CloneBuilder()
+		if !e.finished {
+			b = b.Markup(e.getCancelMarkup())
+		}
+		_, _ = b.Edit(e.ReplyMsgID).Text(ctx, s)
+		e.sendTypingAction(ctx)
+	}
+
+	for _, t := range e.getTargets() {
+		t.finished = e.finished
+		t.editReply(ctx, s)
+	}
 }
 
-type currentlyDownloadedEntryType struct {
+func (e *DownloadQueueEntry) getTargets() []*DownloadQueueEntry {
+	e.targetsMutex.Lock()
+	defer e.targetsMutex.Unlock()
+	return slices.Clone(e.targets)
+}
+
+func (e *DownloadQueueEntry) removeTarget(t *DownloadQueueEntry) {
+	e.targetsMutex.Lock()
+	defer e.targetsMutex.Unlock()
+	if i := slices.Index(e.targets, t); i >= 0 {
+		e.targets = slices.Delete(e.targets, i, i+1)
+	}
+}
+
+// Returns the entries which should get the uploaded media.
+func (e *DownloadQueueEntry) getDeliveryEntries() (entries []*DownloadQueueEntry) {
+	if !e.detached {
+		entries = append(entries, e)
+	}
+	return append(entries, e.getTargets()...)
+}
+
+// Requests are scheduled fairly between requesters. A user's requests in different chats count as
+// different requesters.
+type requesterKey struct {
+	UserID int64
+	ChatID int64
+}
+
+func (e *DownloadQueueEntry) getRequesterKey() requesterKey {
+	k := requesterKey{UserID: e.FromUser.UserID}
+	if e.FromGroup != nil {
+		k.ChatID = getGroupID(e.FromGroup)
+	}
+	return k
+}
+
+// Shows the given error, or that the entry has been canceled, as the error was caused by the cancel.
+func (e *DownloadQueueEntry) editReplyErr(ctx context.Context, err error) {
+	e.finished = true
+	if e.Canceled {
+		fmt.Print("  canceled\n")
+		e.editReply(ctx, canceledStr)
+		return
+	}
+	e.editReply(ctx, fmt.Sprint(errorStr+": ", err))
+	if e.Repost {
+		sendTextToAdmins(ctx, fmt.Sprint(errorStr, " reposting ", e.URL, ": ", err))
+	}
+}
+
+func (e *DownloadQueueEntry) toStored() storedQueueEntry {
+	se := storedQueueEntry{
+		ID:            e.ID,
+		URL:           e.URL,
+		Format:        e.Format,
+		Quality:       e.Quality,
+		PlaylistStart: e.PlaylistStart,
+		PlaylistEnd:   e.PlaylistEnd,
+		PlaylistIndex: e.PlaylistIndex,
+		ClipStart:     e.ClipStart,
+		ClipEnd:       e.ClipEnd,
+		SubLangs:      e.SubLangs,
+		SubMode:       e.SubMode,
+		Repost:        e.Repost,
+		UserID:        e.FromUser.UserID,
+		FromUsername:  e.FromUsername,
+		OrigMsgID:     e.OrigMsgID,
+		TopicID:       e.TopicID,
+		ReplyMsgID:    e.ReplyMsgID,
+		AddedAt:       e.AddedAt,
+	}
+	switch p := e.Peer.(type) {
+	case *tg.InputPeerUser:
+		se.UserAccessHash = p.AccessHash
+	case *tg.InputPeerChat:
+		se.ChatID = p.ChatID
+	case *tg.InputPeerChannel:
+		se.ChannelID = p.ChannelID
+		se.ChannelAccessHash = p.AccessHash
+	}
+	return se
+}
+
+func newDownloadQueueEntryFromStored(se storedQueueEntry) *DownloadQueueEntry {
+	e := &DownloadQueueEntry{
+		ID:            se.ID,
+		URL:           se.URL,
+		Format:        se.Format,
+		Quality:       se.Quality,
+		PlaylistStart: se.PlaylistStart,
+		PlaylistEnd:   se.PlaylistEnd,
+		PlaylistIndex: se.PlaylistIndex,
+		ClipStart:     se.ClipStart,
+		ClipEnd:       se.ClipEnd,
+		SubLangs:      se.SubLangs,
+		SubMode:       se.SubMode,
+		Repost:        se.Repost,
+		FromUser:      &tg.PeerUser{UserID: se.UserID},
+		FromUsername:  se.FromUsername,
+		OrigMsgID:     se.OrigMsgID,
+		TopicID:       se.TopicID,
+		ReplyMsgID:    se.ReplyMsgID,
+		AddedAt:       se.AddedAt,
+		Stage:         stageWaitingStr,
+	}
+	switch {
+	case se.ChatID != 0:
+		e.FromGroup = &tg.PeerChat{ChatID: se.ChatID}
+		e.Peer = &tg.InputPeerChat{ChatID: se.ChatID}
+	case se.ChannelID != 0:
+		e.FromGroup = &tg.PeerChannel{ChannelID: se.ChannelID}
+		e.Peer = &tg.InputPeerChannel{ChannelID: se.ChannelID, AccessHash: se.ChannelAccessHash}
+	default:
+		e.Peer = &tg.InputPeerUser{UserID: se.UserID, AccessHash: se.UserAccessHash}
+	}
+	return e
+}
+
+type progressStateType struct {
 	disableProgressPercentUpdate bool
 	progressPercentUpdateMutex   sync.Mutex
 	lastProgressPercentUpdateAt  time.Time
@@ -78,224 +274,830 @@ type DownloadQueue struct {
 	ctx context.Context
 
 	mutex          sync.Mutex
-	entries        []DownloadQueueEntry
+	entries        []*DownloadQueueEntry
+	activeCount    int
 	processReqChan chan bool
+	// Telegram requests which were collected while the mutex was locked, they are sent by unlock().
+	afterUnlockFuncs []func(ctx context.Context)
+}
+
+func (e *DownloadQueue) getQueuePositionString(qEntry *DownloadQueueEntry, pos int) string {
+	return "👨‍👦‍👦 Request queued at position " + fmt.Sprint(pos) + " (job #" + fmt.Sprint(qEntry.ID) + ")"
+}
+
+// Returns the entries which are being processed.
+func (q *DownloadQueue) getActiveEntries() (activeEntries []*DownloadQueueEntry) {
+	for _, qEntry := range q.entries {
+		if qEntry.Active {
+			activeEntries = append(activeEntries, qEntry)
+		}
+	}
+	return
+}
+
+// Returns the waiting entries in the order they will be processed. Requesters take turns, so a requester's
+// next request is processed after every other requester's earlier queued requests.
+func (q *DownloadQueue) getWaitingEntries() (waitingEntries []*DownloadQueueEntry) {
+	requestCounts := make(map[requesterKey]int)
+	rounds := make(map[*DownloadQueueEntry]int)
+	for _, qEntry := range q.entries {
+		key := qEntry.getRequesterKey()
+		if !qEntry.Active {
+			rounds[qEntry] = requestCounts[key]
+			waitingEntries = append(waitingEntries, qEntry)
+		}
+		requestCounts[key]++
+	}
+
+	sort.SliceStable(waitingEntries, func(i, j int) bool {
+		return rounds[waitingEntries[i]] < rounds[waitingEntries[j]]
+	})
+	return
+}
+
+// Returns the position of the given waiting entry. Positions <= 0 mean that a free worker will process the entry
+// right away.
+func (q *DownloadQueue) getQueuePos(qEntry *DownloadQueueEntry) int {
+	freeWorkers := params.Workers - q.activeCount
+	for i, e := range q.getWaitingEntries() {
+		if e == qEntry {
+			return i + 1 - freeWorkers
+		}
+	}
+	return 0
+}
 
-	currentlyDownloadedEntry currentlyDownloadedEntryType
+// Updates the queue position messages of the waiting entries. Only entries with a changed position get edited.
+// The queue mutex should be locked when calling this function, the messages are edited by unlock().
+func (q *DownloadQueue) updateQueuePositions(ctx context.Context) {
+	freeWorkers := params.Workers - q.activeCount
+	for i, qEntry := range q.getWaitingEntries() {
+		pos := i + 1 - freeWorkers
+		if pos <= 0 || qEntry.lastQueuePos == pos {
+			continue
+		}
+		qEntry.lastQueuePos = pos
+		q.editQueuedReply(qEntry, q.getQueuePositionString(qEntry, pos))
+	}
+}
+
+// Edits the reply of the given waiting entry after the queue mutex gets unlocked. The edit is skipped if the
+// entry's queue position has changed or it got started meanwhile, as then a newer edit follows.
+func (q *DownloadQueue) editQueuedReply(qEntry *DownloadQueueEntry, s string) {
+	pos := qEntry.lastQueuePos
+	q.afterUnlock(func(ctx context.Context) {
+		q.mutex.Lock()
+		current := !qEntry.Active && qEntry.lastQueuePos == pos
+		q.mutex.Unlock()
+		if current {
+			qEntry.editReply(ctx, s)
+		}
+	})
 }
 
-func (e *DownloadQueue) getQueuePositionString(pos int) string {
-	return "👨‍👦‍👦 Request queued at position #" + fmt.Sprint(pos)
+// Sends the given reply for the given new entry, and sets the entry's reply message. The reply shows the given
+// queue position. The entry gets canceled if the reply can't be sent.
+func (q *DownloadQueue) sendReply(ctx context.Context, qEntry *DownloadQueueEntry, s string, pos int) {
+	replyUpd, err := telegramSender.To(qEntry.Peer).Reply(qEntry.OrigMsgID).Markup(qEntry.getCancelMarkup()).Text(ctx, s)
+
+	q.mutex.Lock()
+	if err != nil {
+		fmt.Println("  error sending reply, canceling job #", qEntry.ID, ":", err)
+		if !qEntry.finished {
+			q.cancelEntry(ctx, qEntry)
+			q.updateQueuePositions(ctx)
+		}
+		q.unlock(ctx)
+		return
+	}
+	qEntry.ReplyMsgID, err = getSentMsgID(replyUpd)
+	if err != nil {
+		fmt.Println("  error getting reply message id:", err)
+	}
+	// The position edits which were made while the reply was sent got skipped.
+	if qEntry.lastQueuePos != pos && qEntry.lastQueuePos > 0 && !qEntry.Active {
+		q.editQueuedReply(qEntry, q.getQueuePositionString(qEntry, qEntry.lastQueuePos))
+	}
+	q.unlock(ctx)
 }
 
-func (q *DownloadQueue) Add(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage, url, format string) {
+func (q *DownloadQueue) setEntryStage(qEntry *DownloadQueueEntry, stage string) {
 	q.mutex.Lock()
+	qEntry.Stage = stage
+	q.mutex.Unlock()
+}
 
-	var replyStr string
-	if len(q.entries) == 0 {
-		replyStr = processStartStr
+func (e *DownloadQueueEntry) getListStr(showChat bool) (s string) {
+	s = "#" + fmt.Sprint(e.ID) + " "
+	if e.FromUsername != "" {
+		s += "@" + e.FromUsername
 	} else {
-		fmt.Println("  queueing request at position #", len(q.entries))
-		replyStr = q.getQueuePositionString(len(q.entries))
+		s += "user " + fmt.Sprint(e.FromUser.UserID)
+	}
+	if showChat && e.FromGroup != nil {
+		s += " (group #" + fmt.Sprint(getGroupID(e.FromGroup)) + ")"
+	}
+	if targets := e.getTargets(); len(targets) > 0 {
+		s += " +" + fmt.Sprint(len(targets)) + " more"
 	}
 
-	newEntry := DownloadQueueEntry{
-		URL:           url,
-		Format:        format,
-		OrigEntities:  entities,
-		OrigMsgUpdate: u,
-		OrigMsg:       u.Message.(*tg.Message),
+	if e.Title != "" {
+		s += ": " + e.Title
+	} else {
+		s += ": " + e.URL
 	}
 
-	newEntry.Reply = telegramSender.Reply(entities, u)
-	replyText, _ := newEntry.Reply.Text(ctx, replyStr)
-	newEntry.ReplyMsg = replyText.(*tg.UpdateShortSentMessage)
+	s += " [" + e.Format
+	if e.Quality != "" {
+		s += " " + e.Quality
+	}
+	if e.ClipEnd > 0 {
+		s += " " + getClipStr(e.ClipStart, e.ClipEnd)
+	}
+	if len(e.SubLangs) > 0 {
+		s += " " + e.SubMode + ":" + strings.Join(e.SubLangs, ",")
+	}
+	s += "] " + e.Stage + ", " + time.Since(e.AddedAt).Round(time.Second).String()
+	return
+}
 
-	newEntry.FromUser, newEntry.FromGroup = resolveMsgSrc(newEntry.OrigMsg)
+// Returns the list of active and waiting entries. If showAllChats is false, then only entries from the given
+// chat are listed.
+func (q *DownloadQueue) GetListStr(fromUser *tg.PeerUser, fromGroup tg.PeerClass, showAllChats bool) string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-	q.entries = append(q.entries, newEntry)
+	isFromChat := func(e *DownloadQueueEntry) bool {
+		if showAllChats {
+			return true
+		}
+		if fromGroup != nil {
+			return e.FromGroup != nil && getGroupID(e.FromGroup) == getGroupID(fromGroup)
+		}
+		return e.FromGroup == nil && e.FromUser.UserID == fromUser.UserID
+	}
+
+	var lines []string
+	for _, qEntry := range q.getActiveEntries() {
+		if isFromChat(qEntry) {
+			lines = append(lines, "▶️ "+qEntry.getListStr(showAllChats))
+		}
+	}
+	freeWorkers := params.Workers - q.activeCount
+	for i, qEntry := range q.getWaitingEntries() {
+		if isFromChat(qEntry) {
+			lines = append(lines, fmt.Sprint(max(i+1-freeWorkers, 1), ". ")+qEntry.getListStr(showAllChats))
+		}
+	}
+
+	if len(lines) == 0 {
+		return "📭 The queue is empty"
+	}
+
+	res := "📋 Queue:"
+	for i, l := range lines {
+		if len(res)+len(l) > maxQueueListMsgLength {
+			res += "\n... and " + fmt.Sprint(len(lines)-i) + " more"
+			break
+		}
+		res += "\n" + l
+	}
+	return res
+}
+
+func (q *DownloadQueue) removeEntry(qEntry *DownloadQueueEntry) {
+	for i := range q.entries {
+		if q.entries[i] == qEntry {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Runs the given function after the queue mutex gets unlocked by unlock(), so Telegram requests don't block the
+// queue. The queue mutex should be locked when calling this function.
+func (q *DownloadQueue) afterUnlock(f func(ctx context.Context)) {
+	q.afterUnlockFuncs = append(q.afterUnlockFuncs, f)
+}
+
+// Unlocks the queue mutex, and runs the functions which were added by afterUnlock() while it was locked.
+func (q *DownloadQueue) unlock(ctx context.Context) {
+	funcs := q.afterUnlockFuncs
+	q.afterUnlockFuncs = nil
 	q.mutex.Unlock()
 
+	for _, f := range funcs {
+		f(ctx)
+	}
+}
+
+func (q *DownloadQueue) signalProcessor() {
 	select {
 	case q.processReqChan <- true:
 	default:
 	}
 }
 
-func (q *DownloadQueue) CancelCurrentEntry(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage, url string) {
+// Adds the given entry to the queue. Only the request fields (URL, Format, Quality, PlaylistStart, PlaylistEnd) of
+// the new entry need to be set, the rest is filled from the given update. If the new entry's ReplyMsgID is set, then
+// that message is used as the reply, otherwise a new reply is sent.
+func (q *DownloadQueue) Add(ctx context.Context, entities tg.Entities, u message.AnswerableMessageUpdate, newEntry *DownloadQueueEntry) {
+	msg := u.GetMessage().(*tg.Message)
+	newEntry.OrigMsgID = msg.ID
+	newEntry.FromUser, newEntry.FromGroup = resolveMsgSrc(msg)
+	newEntry.TopicID = getTopicID(msg)
+	newEntry.FromUsername = getFromUsername(entities, newEntry.FromUser.UserID)
+	newEntry.Peer = getInputPeer(entities, newEntry.FromUser, newEntry.FromGroup)
+
+	// Already uploaded media is sent right away, without queueing.
+	if sendCachedMedia(ctx, newEntry) {
+		return
+	}
+
 	q.mutex.Lock()
-	if len(q.entries) > 0 {
-		q.entries[0].Canceled = true
-		q.entries[0].CtxCancel()
+	var err error
+	if qEntry := q.getEntryForSameMedia(newEntry); qEntry != nil {
+		err = q.attachEntry(ctx, qEntry, newEntry)
 	} else {
-		fmt.Println("  no active request to cancel")
-		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": no active request to cancel")
+		err = q.addEntry(ctx, newEntry)
+	}
+	q.unlock(ctx)
+
+	if err != nil {
+		fmt.Println("  error:", err)
+		_, _ = telegramSender.Reply(entities, u).Text(ctx, errorStr+": can't queue request")
+		return
+	}
+	q.signalProcessor()
+}
+
+// Returns the waiting or active entry which requests the same media as the given new entry, or nil if there's
+// none. Playlists are not checked, as they get expanded to album items.
+func (q *DownloadQueue) getEntryForSameMedia(newEntry *DownloadQueueEntry) *DownloadQueueEntry {
+	if newEntry.PlaylistStart > 0 {
+		return nil
 	}
+	key := getMediaCacheKey(newEntry)
+	for _, qEntry := range q.entries {
+		if qEntry.album != nil || qEntry.PlaylistStart > 0 || qEntry.Canceled || qEntry.finished || qEntry.sent {
+			continue
+		}
+		if getMediaCacheKey(qEntry) == key {
+			return qEntry
+		}
+	}
+	return nil
+}
+
+// Attaches the given new entry to the given entry, so the work is only done once, and the new entry gets the
+// progress updates and the uploaded media. The new entry is stored, so after a restart it's restored as a
+// separate entry. The queue mutex should be locked when calling this function, the reply is sent by unlock().
+func (q *DownloadQueue) attachEntry(ctx context.Context, qEntry, newEntry *DownloadQueueEntry) (err error) {
+	newEntry.AddedAt = time.Now()
+	newEntry.Stage = stageWaitingStr
+	newEntry.attachedTo = qEntry
+
+	newEntry.ID, err = store.NextQueueEntryID()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("  attaching request to job #", qEntry.ID)
+	replyStr := fmt.Sprint(attachedStr, " (job #", qEntry.ID, ")")
+	if newEntry.ReplyMsgID != 0 {
+		q.afterUnlock(func(ctx context.Context) { newEntry.editReply(ctx, replyStr) })
+	} else if !newEntry.Repost {
+		q.afterUnlock(func(ctx context.Context) { q.sendReply(ctx, newEntry, replyStr, 0) })
+	}
+
+	if err := store.PutQueueEntry(newEntry.toStored()); err != nil {
+		fmt.Println("  error storing queue entry:", err)
+	}
+
+	qEntry.targetsMutex.Lock()
+	qEntry.targets = append(qEntry.targets, newEntry)
+	qEntry.targetsMutex.Unlock()
+	return nil
+}
+
+// Adds the given entry to the queue. The entry's source fields (Peer, FromUser, FromGroup, FromUsername, OrigMsgID)
+// need to be set. The queue mutex should be locked when calling this function, the reply is sent by unlock().
+func (q *DownloadQueue) addEntry(ctx context.Context, newEntry *DownloadQueueEntry) (err error) {
+	newEntry.AddedAt = time.Now()
+	newEntry.Stage = stageWaitingStr
+
+	newEntry.ID, err = store.NextQueueEntryID()
+	if err != nil {
+		return err
+	}
+	q.entries = append(q.entries, newEntry)
+
+	var replyStr string
+	newEntry.lastQueuePos = q.getQueuePos(newEntry)
+	if newEntry.lastQueuePos <= 0 {
+		replyStr = processStartStr
+	} else {
+		fmt.Println("  queueing request at position #", newEntry.lastQueuePos)
+		replyStr = q.getQueuePositionString(newEntry, newEntry.lastQueuePos)
+	}
+
+	if newEntry.ReplyMsgID != 0 {
+		q.editQueuedReply(newEntry, replyStr)
+	} else if !newEntry.Repost {
+		pos := newEntry.lastQueuePos
+		q.afterUnlock(func(ctx context.Context) { q.sendReply(ctx, newEntry, replyStr, pos) })
+	}
+
+	if err := store.PutQueueEntry(newEntry.toStored()); err != nil {
+		fmt.Println("  error storing queue entry:", err)
+	}
+
+	// The new entry may have been scheduled before already waiting entries.
+	q.updateQueuePositions(ctx)
+	return nil
+}
+
+// Replaces the given playlist entry with entries for each of the given playlist items. Items are grouped into
+// albums.
+func (q *DownloadQueue) addPlaylistItems(ctx context.Context, qEntry *DownloadQueueEntry, items []PlaylistItem) {
+	q.mutex.Lock()
+	var album *playlistAlbum
+	for i, item := range items {
+		if i%maxAlbumSize == 0 {
+			album = &playlistAlbum{
+				peer:         qEntry.Peer,
+				replyToMsgID: qEntry.OrigMsgID,
+				pending:      min(maxAlbumSize, len(items)-i),
+			}
+		}
+
+		newEntry := &DownloadQueueEntry{
+			URL:          item.URL,
+			Format:       qEntry.Format,
+			Quality:      qEntry.Quality,
+			ClipStart:    qEntry.ClipStart,
+			ClipEnd:      qEntry.ClipEnd,
+			SubLangs:     qEntry.SubLangs,
+			SubMode:      qEntry.SubMode,
+			Peer:         qEntry.Peer,
+			FromUser:     qEntry.FromUser,
+			FromGroup:    qEntry.FromGroup,
+			FromUsername: qEntry.FromUsername,
+			OrigMsgID:    qEntry.OrigMsgID,
+			TopicID:      qEntry.TopicID,
+			Repost:       qEntry.Repost,
+			album:        album,
+		}
+		if newEntry.URL == "" {
+			// The item can only be downloaded from the playlist.
+			newEntry.URL = qEntry.URL
+			newEntry.PlaylistIndex = item.Index
+		}
+		if err := q.addEntry(ctx, newEntry); err != nil {
+			fmt.Println("  error adding playlist item:", err)
+			itemAlbum := album
+			q.afterUnlock(func(ctx context.Context) { itemAlbum.addItem(ctx, nil) })
+		}
+	}
+	q.unlock(ctx)
+
+	q.signalProcessor()
+}
+
+// Cancels the given entry. Active entries get their context canceled, waiting entries are removed from the queue.
+// The queue mutex should be locked when calling this function, the replies are edited by unlock().
+func (q *DownloadQueue) cancelEntry(ctx context.Context, qEntry *DownloadQueueEntry) {
+	if qEntry.attachedTo != nil {
+		q.cancelAttachedEntry(ctx, qEntry)
+		return
+	}
+
+	if targets := qEntry.getTargets(); len(targets) > 0 {
+		if qEntry.Active {
+			// The attached requesters still need the media, so only the requester gets detached.
+			if err := store.DeleteQueueEntry(qEntry.ID); err != nil {
+				fmt.Println("  error deleting stored queue entry:", err)
+			}
+			replyMsgID := qEntry.ReplyMsgID
+			q.afterUnlock(func(ctx context.Context) {
+				_, _ = telegramSender.To(qEntry.Peer).Edit(replyMsgID).Text(ctx, canceledStr)
+			})
+			qEntry.detached = true
+			return
+		}
+
+		// The first attached entry takes the place of the canceled waiting entry.
+		newEntry := targets[0]
+		newEntry.attachedTo = nil
+		for _, t := range targets[1:] {
+			t.attachedTo = newEntry
+		}
+		newEntry.targetsMutex.Lock()
+		newEntry.targets = targets[1:]
+		newEntry.targetsMutex.Unlock()
+		qEntry.targetsMutex.Lock()
+		qEntry.targets = nil
+		qEntry.targetsMutex.Unlock()
+		q.entries[slices.Index(q.entries, qEntry)] = newEntry
+		newEntry.lastQueuePos = 0
+
+		if err := store.DeleteQueueEntry(qEntry.ID); err != nil {
+			fmt.Println("  error deleting stored queue entry:", err)
+		}
+		qEntry.finished = true
+		q.afterUnlock(func(ctx context.Context) { qEntry.editReply(ctx, canceledStr) })
+		return
+	}
+
+	if qEntry.Active {
+		qEntry.Canceled = true
+		qEntry.CtxCancel()
+		return
+	}
+
+	q.removeEntry(qEntry)
+	if err := store.DeleteQueueEntry(qEntry.ID); err != nil {
+		fmt.Println("  error deleting stored queue entry:", err)
+	}
+	qEntry.finished = true
+	q.afterUnlock(func(ctx context.Context) {
+		qEntry.editReply(ctx, canceledStr)
+		if qEntry.album != nil {
+			qEntry.album.addItem(ctx, nil)
+		}
+	})
+}
+
+// Detaches the given attached entry from the entry which does the work. If nobody needs the work anymore, then
+// it gets canceled.
+func (q *DownloadQueue) cancelAttachedEntry(ctx context.Context, qEntry *DownloadQueueEntry) {
+	workEntry := qEntry.attachedTo
+	workEntry.removeTarget(qEntry)
+	qEntry.attachedTo = nil
+
+	if err := store.DeleteQueueEntry(qEntry.ID); err != nil {
+		fmt.Println("  error deleting stored queue entry:", err)
+	}
+	qEntry.finished = true
+	q.afterUnlock(func(ctx context.Context) { qEntry.editReply(ctx, canceledStr) })
+
+	if workEntry.detached && len(workEntry.getTargets()) == 0 {
+		workEntry.Canceled = true
+		workEntry.CtxCancel()
+	}
+}
+
+// Detaches the given attached entry which couldn't get the media, and shows the error on its reply, so the final
+// progress update of the entry which does the work doesn't show it as done.
+func (q *DownloadQueue) failAttachedEntry(ctx context.Context, qEntry *DownloadQueueEntry, err error) {
+	q.mutex.Lock()
+	// The requester may have canceled meanwhile, then the entry is already detached.
+	if qEntry.attachedTo == nil || qEntry.Canceled {
+		q.mutex.Unlock()
+		return
+	}
+	qEntry.attachedTo.removeTarget(qEntry)
+	qEntry.attachedTo = nil
 	q.mutex.Unlock()
+
+	if err := store.DeleteQueueEntry(qEntry.ID); err != nil {
+		fmt.Println("  error deleting stored queue entry:", err)
+	}
+	qEntry.editReplyErr(ctx, err)
+}
+
+// Returns the given entries followed by their attached entries.
+func withAttachedEntries(entries []*DownloadQueueEntry) (res []*DownloadQueueEntry) {
+	for _, qEntry := range entries {
+		res = append(res, qEntry)
+		res = append(res, qEntry.getTargets()...)
+	}
+	return
+}
+
+// Cancels the requests selected by the given argument, which can be:
+//   - empty: the oldest request of the given user in the given chat,
+//   - "all": all requests of the given user,
+//   - a number: the waiting request at the given queue position,
+//   - a number prefixed with #: the request with the given job ID,
+//   - an URL: the requests in the given chat with the given URL.
+//
+// Only the owner of a request or an admin can cancel the request.
+func (q *DownloadQueue) Cancel(ctx context.Context, fromUser *tg.PeerUser, fromGroup tg.PeerClass, arg string) error {
+	q.mutex.Lock()
+	defer q.unlock(ctx)
+
+	isAdmin := slices.Contains(params.AdminUserIDs, fromUser.UserID)
+	isOwn := func(e *DownloadQueueEntry) bool {
+		return e.FromUser.UserID == fromUser.UserID
+	}
+	isFromChat := func(e *DownloadQueueEntry) bool {
+		if fromGroup != nil {
+			return e.FromGroup != nil && getGroupID(e.FromGroup) == getGroupID(fromGroup)
+		}
+		return e.FromGroup == nil
+	}
+
+	var toCancel []*DownloadQueueEntry
+	arg = strings.TrimSpace(arg)
+	switch {
+	case arg == "":
+		// Preferring the active entries, then the next waiting ones.
+		for _, qEntry := range withAttachedEntries(append(q.getActiveEntries(), q.getWaitingEntries()...)) {
+			if isOwn(qEntry) && isFromChat(qEntry) && !qEntry.detached {
+				toCancel = append(toCancel, qEntry)
+				break
+			}
+		}
+	case arg == "all":
+		for _, qEntry := range withAttachedEntries(q.entries) {
+			if isOwn(qEntry) && !qEntry.detached {
+				toCancel = append(toCancel, qEntry)
+			}
+		}
+	case strings.HasPrefix(arg, "#"):
+		id, err := strconv.ParseUint(arg[1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid job id")
+		}
+		for _, qEntry := range withAttachedEntries(q.entries) {
+			if qEntry.ID == id && !qEntry.detached {
+				toCancel = append(toCancel, qEntry)
+				break
+			}
+		}
+	default:
+		if pos, err := strconv.Atoi(arg); err == nil {
+			freeWorkers := params.Workers - q.activeCount
+			for i, qEntry := range q.getWaitingEntries() {
+				if i+1-freeWorkers == pos {
+					toCancel = append(toCancel, qEntry)
+					break
+				}
+			}
+			break
+		}
+
+		for _, qEntry := range withAttachedEntries(q.entries) {
+			if qEntry.URL == arg && isFromChat(qEntry) && (isOwn(qEntry) || isAdmin) && !qEntry.detached {
+				toCancel = append(toCancel, qEntry)
+			}
+		}
+	}
+
+	if len(toCancel) == 0 {
+		return fmt.Errorf("no matching request to cancel")
+	}
+
+	for _, qEntry := range toCancel {
+		if !isOwn(qEntry) && !isAdmin {
+			return fmt.Errorf("only the requester or an admin can cancel job #%d", qEntry.ID)
+		}
+	}
+
+	for _, qEntry := range toCancel {
+		fmt.Println("  canceling job #", qEntry.ID)
+		q.cancelEntry(ctx, qEntry)
+	}
+	q.updateQueuePositions(ctx)
+	return nil
 }
 
 func (q *DownloadQueue) updateProgress(ctx context.Context, qEntry *DownloadQueueEntry, progressStr string, progressPercent int) {
 	if progressPercent < 0 {
-		qEntry.editReply(ctx, progressStr+"... (no progress available)\n"+q.currentlyDownloadedEntry.sourceCodecInfo)
+		qEntry.editReply(ctx, progressStr+"... (no progress available)\n"+qEntry.progress.sourceCodecInfo)
 		return
 	}
 	if progressPercent == 0 {
-		qEntry.editReply(ctx, progressStr+"..."+q.currentlyDownloadedEntry.progressInfo+"\n"+q.currentlyDownloadedEntry.sourceCodecInfo)
+		qEntry.editReply(ctx, progressStr+"..."+qEntry.progress.progressInfo+"\n"+qEntry.progress.sourceCodecInfo)
 		return
 	}
 	fmt.Print("  progress: ", progressPercent, "%\n")
-	qEntry.editReply(ctx, progressStr+": "+getProgressbar(progressPercent, progressBarLength)+q.currentlyDownloadedEntry.progressInfo+"\n"+q.currentlyDownloadedEntry.sourceCodecInfo)
-	q.currentlyDownloadedEntry.lastDisplayedProgressPercent = progressPercent
+	qEntry.editReply(ctx, progressStr+": "+getProgressbar(progressPercent, progressBarLength)+qEntry.progress.progressInfo+"\n"+qEntry.progress.sourceCodecInfo)
+	qEntry.progress.lastDisplayedProgressPercent = progressPercent
 }
 
-func (q *DownloadQueue) HandleProgressPercentUpdate(progressStr string, progressPercent int) {
-	q.currentlyDownloadedEntry.progressPercentUpdateMutex.Lock()
-	defer q.currentlyDownloadedEntry.progressPercentUpdateMutex.Unlock()
+func (q *DownloadQueue) HandleProgressPercentUpdate(qEntry *DownloadQueueEntry, progressStr string, progressPercent int) {
+	qEntry.progress.progressPercentUpdateMutex.Lock()
+	defer qEntry.progress.progressPercentUpdateMutex.Unlock()
 
-	if q.currentlyDownloadedEntry.disableProgressPercentUpdate || q.currentlyDownloadedEntry.lastProgressPercent == progressPercent {
+	if qEntry.progress.disableProgressPercentUpdate || qEntry.progress.lastProgressPercent == progressPercent {
 		return
 	}
-	q.currentlyDownloadedEntry.lastProgressPercent = progressPercent
+	qEntry.progress.lastProgressPercent = progressPercent
 	if progressPercent < 0 {
-		q.currentlyDownloadedEntry.disableProgressPercentUpdate = true
-		q.updateProgress(q.ctx, &q.entries[0], progressStr, progressPercent)
+		qEntry.progress.disableProgressPercentUpdate = true
+		q.updateProgress(q.ctx, qEntry, progressStr, progressPercent)
 		return
 	}
 
-	if q.currentlyDownloadedEntry.progressUpdateTimer != nil {
-		q.currentlyDownloadedEntry.progressUpdateTimer.Stop()
+	if qEntry.progress.progressUpdateTimer != nil {
+		qEntry.progress.progressUpdateTimer.Stop()
 		select {
-		case <-q.currentlyDownloadedEntry.progressUpdateTimer.C:
+		case <-qEntry.progress.progressUpdateTimer.C:
 		default:
 		}
 	}
 
-	timeElapsedSinceLastUpdate := time.Since(q.currentlyDownloadedEntry.lastProgressPercentUpdateAt)
+	timeElapsedSinceLastUpdate := time.Since(qEntry.progress.lastProgressPercentUpdateAt)
 	if timeElapsedSinceLastUpdate < maxProgressPercentUpdateInterval {
-		q.currentlyDownloadedEntry.progressUpdateTimer = time.AfterFunc(maxProgressPercentUpdateInterval-timeElapsedSinceLastUpdate, func() {
-			q.currentlyDownloadedEntry.progressPercentUpdateMutex.Lock()
-			if !q.currentlyDownloadedEntry.disableProgressPercentUpdate {
-				q.updateProgress(q.ctx, &q.entries[0], progressStr, progressPercent)
-				q.currentlyDownloadedEntry.lastProgressPercentUpdateAt = time.Now()
+		qEntry.progress.progressUpdateTimer = time.AfterFunc(maxProgressPercentUpdateInterval-timeElapsedSinceLastUpdate, func() {
+			qEntry.progress.progressPercentUpdateMutex.Lock()
+			if !qEntry.progress.disableProgressPercentUpdate {
+				q.updateProgress(q.ctx, qEntry, progressStr, progressPercent)
+				qEntry.progress.lastProgressPercentUpdateAt = time.Now()
 			}
-			q.currentlyDownloadedEntry.progressPercentUpdateMutex.Unlock()
+			qEntry.progress.progressPercentUpdateMutex.Unlock()
 		})
 		return
 	}
-	q.updateProgress(q.ctx, &q.entries[0], progressStr, progressPercent)
-	q.currentlyDownloadedEntry.lastProgressPercentUpdateAt = time.Now()
+	q.updateProgress(q.ctx, qEntry, progressStr, progressPercent)
+	qEntry.progress.lastProgressPercentUpdateAt = time.Now()
 }
 
 func (q *DownloadQueue) processQueueEntry(ctx context.Context, qEntry *DownloadQueueEntry) {
-	fromUsername := getFromUsername(qEntry.OrigEntities, qEntry.FromUser.UserID)
 	fmt.Print("processing request by")
-	if fromUsername != "" {
-		fmt.Print(" from ", fromUsername, "#", qEntry.FromUser.UserID)
+	if qEntry.FromUsername != "" {
+		fmt.Print(" from ", qEntry.FromUsername, "#", qEntry.FromUser.UserID)
 	}
 	fmt.Println(":", qEntry.URL)
 
 	qEntry.editReply(ctx, processStartStr)
+	q.setEntryStage(qEntry, stageProbingStr)
 
 	downloader := Downloader{
+		Quality:       qEntry.Quality,
+		PlaylistStart: qEntry.PlaylistStart,
+		PlaylistEnd:   qEntry.PlaylistEnd,
+		PlaylistIndex: qEntry.PlaylistIndex,
+		ClipStart:     qEntry.ClipStart,
+		ClipEnd:       qEntry.ClipEnd,
+		SubtitleLangs: qEntry.SubLangs,
+		SubtitleMode:  qEntry.SubMode,
 		ConvertStartFunc: func(ctx context.Context, videoCodecs, audioCodecs, convertActionsNeeded string) {
-			q.currentlyDownloadedEntry.sourceCodecInfo = "🎬 Source: " + videoCodecs
+			qEntry.progress.sourceCodecInfo = "🎬 Source: " + videoCodecs
 			if audioCodecs == "" {
-				q.currentlyDownloadedEntry.sourceCodecInfo += ", no audio"
+				qEntry.progress.sourceCodecInfo += ", no audio"
 			} else {
 				if videoCodecs != "" {
-					q.currentlyDownloadedEntry.sourceCodecInfo += " / "
+					qEntry.progress.sourceCodecInfo += " / "
 				}
-				q.currentlyDownloadedEntry.sourceCodecInfo += audioCodecs
+				qEntry.progress.sourceCodecInfo += audioCodecs
 			}
 			if convertActionsNeeded == "" {
-				q.currentlyDownloadedEntry.sourceCodecInfo += " (no conversion needed)"
+				qEntry.progress.sourceCodecInfo += " (no conversion needed)"
 			} else {
-				q.currentlyDownloadedEntry.sourceCodecInfo += " (converting: " + convertActionsNeeded + ")"
+				qEntry.progress.sourceCodecInfo += " (converting: " + convertActionsNeeded + ")"
 			}
-			qEntry.editReply(ctx, "🎬 Preparing download...\n"+q.currentlyDownloadedEntry.sourceCodecInfo)
+			qEntry.editReply(ctx, "🎬 Preparing download...\n"+qEntry.progress.sourceCodecInfo)
 		},
-		UpdateProgressPercentFunc: q.HandleProgressPercentUpdate,
+		UpdateProgressPercentFunc: func(progressStr string, progressPercent int) {
+			q.HandleProgressPercentUpdate(qEntry, progressStr, progressPercent)
+		},
+	}
+
+	if params.OversizeMode == oversizeModeCompress {
+		downloader.FitSize = getMaxUploadSize()
 	}
+	downloader.Timeout = params.ConvertTimeout
 
-	r, outputFormat, title, err := downloader.DownloadAndConvertURL(qEntry.Ctx, qEntry.OrigMsg.Message, qEntry.Format)
+	res, err := downloader.DownloadAndConvertURL(qEntry.Ctx, qEntry.URL, qEntry.Format)
+	var playlistErr *PlaylistError
+	if errors.As(err, &playlistErr) {
+		fmt.Println("  got playlist with", len(playlistErr.Items), "items")
+		qEntry.finished = true
+		qEntry.editReply(ctx, fmt.Sprint(playlistStr, ": ", playlistErr.Title, " (", len(playlistErr.Items), " items queued)"))
+		q.addPlaylistItems(ctx, qEntry, playlistErr.Items)
+		for _, t := range qEntry.getTargets() {
+			q.addPlaylistItems(ctx, t, playlistErr.Items)
+		}
+		return
+	}
 	if err != nil {
 		fmt.Println("  error downloading:", err)
-		q.currentlyDownloadedEntry.progressPercentUpdateMutex.Lock()
-		q.currentlyDownloadedEntry.disableProgressPercentUpdate = true
-		q.currentlyDownloadedEntry.progressPercentUpdateMutex.Unlock()
-		qEntry.editReply(ctx, fmt.Sprint(errorStr+": ", err))
+		qEntry.progress.progressPercentUpdateMutex.Lock()
+		qEntry.progress.disableProgressPercentUpdate = true
+		qEntry.progress.progressPercentUpdateMutex.Unlock()
+		qEntry.editReplyErr(ctx, err)
 		return
 	}
+	defer res.Cleanup()
+
+	q.mutex.Lock()
+	qEntry.Title = res.Title
+	qEntry.Stage = stageConvertingStr
+	q.mutex.Unlock()
 
 	// Feeding the returned io.ReadCloser to the uploader.
 	fmt.Println("  processing...")
-	q.currentlyDownloadedEntry.progressPercentUpdateMutex.Lock()
-	q.updateProgress(ctx, qEntry, processStr, q.currentlyDownloadedEntry.lastProgressPercent)
-	q.currentlyDownloadedEntry.progressPercentUpdateMutex.Unlock()
+	qEntry.progress.progressPercentUpdateMutex.Lock()
+	q.updateProgress(ctx, qEntry, processStr, qEntry.progress.lastProgressPercent)
+	qEntry.progress.progressPercentUpdateMutex.Unlock()
 
-	err = dlUploader.UploadFile(qEntry.Ctx, qEntry.OrigEntities, qEntry.OrigMsgUpdate, r, outputFormat, title)
+	dlUploader := Uploader{qEntry: qEntry}
+	err = dlUploader.UploadFile(qEntry.Ctx, res)
 	if err != nil {
 		fmt.Println("  error processing:", err)
-		q.currentlyDownloadedEntry.progressPercentUpdateMutex.Lock()
-		q.currentlyDownloadedEntry.disableProgressPercentUpdate = true
-		q.currentlyDownloadedEntry.progressPercentUpdateMutex.Unlock()
-		r.Close()
-		qEntry.editReply(ctx, fmt.Sprint(errorStr+": ", err))
+		qEntry.progress.progressPercentUpdateMutex.Lock()
+		qEntry.progress.disableProgressPercentUpdate = true
+		qEntry.progress.progressPercentUpdateMutex.Unlock()
+		res.Reader.Close()
+		qEntry.editReplyErr(ctx, err)
 		return
 	}
-	q.currentlyDownloadedEntry.progressPercentUpdateMutex.Lock()
-	q.currentlyDownloadedEntry.disableProgressPercentUpdate = true
-	q.currentlyDownloadedEntry.progressPercentUpdateMutex.Unlock()
-	r.Close()
+	qEntry.progress.progressPercentUpdateMutex.Lock()
+	qEntry.progress.disableProgressPercentUpdate = true
+	qEntry.progress.progressPercentUpdateMutex.Unlock()
+	res.Reader.Close()
 
-	q.currentlyDownloadedEntry.progressPercentUpdateMutex.Lock()
+	qEntry.progress.progressPercentUpdateMutex.Lock()
+	qEntry.finished = true
 	if qEntry.Canceled {
 		fmt.Print("  canceled\n")
-		q.updateProgress(ctx, qEntry, canceledStr, q.currentlyDownloadedEntry.lastProgressPercent)
-	} else if q.currentlyDownloadedEntry.lastDisplayedProgressPercent < 100 {
+		q.updateProgress(ctx, qEntry, canceledStr, qEntry.progress.lastProgressPercent)
+	} else {
+		// Always updating, as the cancel button needs to be removed.
 		fmt.Print("  progress: 100%\n")
 		q.updateProgress(ctx, qEntry, uploadDoneStr, 100)
 	}
-	q.currentlyDownloadedEntry.progressPercentUpdateMutex.Unlock()
+	qEntry.progress.progressPercentUpdateMutex.Unlock()
 	qEntry.sendTypingCancelAction(ctx)
 }
 
 func (q *DownloadQueue) processor() {
 	for {
 		q.mutex.Lock()
-		if (len(q.entries)) == 0 {
+		waitingEntries := q.getWaitingEntries()
+		if len(waitingEntries) == 0 || q.activeCount >= params.Workers {
 			q.mutex.Unlock()
 			<-q.processReqChan
 			continue
 		}
 
-		// Updating queue positions for all waiting entries.
-		for i := 1; i < len(q.entries); i++ {
-			q.entries[i].editReply(q.ctx, q.getQueuePositionString(i))
-			q.entries[i].sendTypingCancelAction(q.ctx)
-		}
+		qEntry := waitingEntries[0]
+		qEntry.Active = true
+		qEntry.Ctx, qEntry.CtxCancel = context.WithCancel(q.ctx)
+		q.activeCount++
 
-		q.entries[0].Ctx, q.entries[0].CtxCancel = context.WithTimeout(q.ctx, downloadAndConvertTimeout)
+		q.updateQueuePositions(q.ctx)
+		q.unlock(q.ctx)
 
-		qEntry := &q.entries[0]
-		q.mutex.Unlock()
+		go func() {
+			q.processQueueEntry(q.ctx, qEntry)
+			if qEntry.album != nil {
+				qEntry.album.addItem(q.ctx, qEntry.albumMedia)
+			}
+
+			for _, e := range append([]*DownloadQueueEntry{qEntry}, qEntry.getTargets()...) {
+				if err := store.DeleteQueueEntry(e.ID); err != nil {
+					fmt.Println("  error deleting stored queue entry:", err)
+				}
+			}
 
-		q.currentlyDownloadedEntry = currentlyDownloadedEntryType{}
+			q.mutex.Lock()
+			qEntry.CtxCancel()
+			q.removeEntry(qEntry)
+			q.activeCount--
+			if len(q.entries) == 0 {
+				fmt.Print("finished queue processing\n")
+			}
+			q.mutex.Unlock()
 
-		q.processQueueEntry(q.ctx, qEntry)
+			q.signalProcessor()
+		}()
+	}
+}
 
-		q.mutex.Lock()
-		q.entries[0].CtxCancel()
-		q.entries = q.entries[1:]
-		if len(q.entries) == 0 {
-			fmt.Print("finished queue processing\n")
+// Loads the entries which were left in the queue when the bot stopped.
+func (q *DownloadQueue) restoreEntries(ctx context.Context) {
+	storedEntries, err := store.GetQueueEntries()
+	if err != nil {
+		fmt.Println("error loading stored queue entries:", err)
+		return
+	}
+	if len(storedEntries) == 0 {
+		return
+	}
+
+	fmt.Println("resuming", len(storedEntries), "queued requests after restart")
+	for _, se := range storedEntries {
+		q.entries = append(q.entries, newDownloadQueueEntryFromStored(se))
+	}
+
+	for _, qEntry := range q.entries {
+		qEntry.lastQueuePos = q.getQueuePos(qEntry)
+		if qEntry.lastQueuePos <= 0 {
+			qEntry.editReply(ctx, resumeStr+"\n"+processStartStr)
+		} else {
+			qEntry.editReply(ctx, resumeStr+"\n"+q.getQueuePositionString(qEntry, qEntry.lastQueuePos))
 		}
-		q.mutex.Unlock()
 	}
 }
 
 func (q *DownloadQueue) Init(ctx context.Context) {
 	q.ctx = ctx
-	q.processReqChan = make(chan bool)
+	q.restoreEntries(ctx)
+	// Buffered, so a signal sent while the processor is busy won't get lost.
+	q.processReqChan = make(chan bool, 1)
 	go q.processor()
 }
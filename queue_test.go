@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"golang.org/x/exp/slices"
+)
+
+// Returns a queue entry of the given user in the given group, or in a private chat if groupID is 0.
+func newTestQueueEntry(id uint64, userID, groupID int64, active bool) *DownloadQueueEntry {
+	e := &DownloadQueueEntry{ID: id, FromUser: &tg.PeerUser{UserID: userID}, Active: active}
+	if groupID != 0 {
+		e.FromGroup = &tg.PeerChat{ChatID: groupID}
+	}
+	return e
+}
+
+func getEntryIDs(entries []*DownloadQueueEntry) (ids []uint64) {
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return
+}
+
+func TestGetWaitingEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*DownloadQueueEntry
+		want    []uint64
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "single requester keeps the order",
+			entries: []*DownloadQueueEntry{
+				newTestQueueEntry(1, 10, 0, false),
+				newTestQueueEntry(2, 10, 0, false),
+				newTestQueueEntry(3, 10, 0, false),
+			},
+			want: []uint64{1, 2, 3},
+		},
+		{
+			name: "requesters take turns",
+			entries: []*DownloadQueueEntry{
+				newTestQueueEntry(1, 10, 0, false),
+				newTestQueueEntry(2, 10, 0, false),
+				newTestQueueEntry(3, 10, 0, false),
+				newTestQueueEntry(4, 20, 0, false),
+				newTestQueueEntry(5, 30, 0, false),
+				newTestQueueEntry(6, 20, 0, false),
+			},
+			want: []uint64{1, 4, 5, 2, 6, 3},
+		},
+		{
+			name: "active entries count as the requester's earlier requests",
+			entries: []*DownloadQueueEntry{
+				newTestQueueEntry(1, 10, 0, true),
+				newTestQueueEntry(2, 10, 0, false),
+				newTestQueueEntry(3, 20, 0, false),
+			},
+			want: []uint64{3, 2},
+		},
+		{
+			name: "the same user in different chats are different requesters",
+			entries: []*DownloadQueueEntry{
+				newTestQueueEntry(1, 10, 0, false),
+				newTestQueueEntry(2, 10, 0, false),
+				newTestQueueEntry(3, 10, 100, false),
+			},
+			want: []uint64{1, 3, 2},
+		},
+	}
+	for _, tt := range tests {
+		q := DownloadQueue{entries: tt.entries}
+		if got := getEntryIDs(q.getWaitingEntries()); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: getWaitingEntries() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetQueuePos(t *testing.T) {
+	entries := []*DownloadQueueEntry{
+		newTestQueueEntry(1, 10, 0, true),
+		newTestQueueEntry(2, 10, 0, false),
+		newTestQueueEntry(3, 10, 0, false),
+		newTestQueueEntry(4, 20, 0, false),
+	}
+	tests := []struct {
+		workers int
+		// Expected positions of the entries, active entries have position 0.
+		want []int
+	}{
+		{workers: 1, want: []int{0, 2, 3, 1}},
+		{workers: 2, want: []int{0, 1, 2, 0}},
+		{workers: 4, want: []int{0, -1, 0, -2}},
+	}
+	for _, tt := range tests {
+		params.Workers = tt.workers
+		q := DownloadQueue{entries: entries, activeCount: 1}
+		for i, e := range entries {
+			if got := q.getQueuePos(e); got != tt.want[i] {
+				t.Errorf("workers %d: getQueuePos(#%d) = %d, want %d", tt.workers, e.ID, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -13,6 +13,16 @@ BOT_TOKEN=$BOT_TOKEN \
 ALLOWED_USERIDS=$ALLOWED_USERIDS \
 ADMIN_USERIDS=$ADMIN_USERIDS \
 ALLOWED_GROUPIDS=$ALLOWED_GROUPIDS \
+REPOST_CHANNELIDS=$REPOST_CHANNELIDS \
+REPOST_MODE=$REPOST_MODE \
 MAX_SIZE=$MAX_SIZE \
+OVERSIZE_MODE=$OVERSIZE_MODE \
+WORKERS=$WORKERS \
+CONVERT_TIMEOUT=$CONVERT_TIMEOUT \
+DB_PATH=$DB_PATH \
+DEFAULT_QUALITY=$DEFAULT_QUALITY \
+FORMAT_PICKER_TIMEOUT=$FORMAT_PICKER_TIMEOUT \
+MAX_PLAYLIST_ITEMS=$MAX_PLAYLIST_ITEMS \
+CAPTION_TEMPLATE=$CAPTION_TEMPLATE \
 YTDLP_PATH=$YTDLP_PATH \
 $bin
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const storeOpenTimeout = 5 * time.Second
+
+var storeQueueBucket = []byte("queue")
+var storeCaptionsBucket = []byte("captions")
+var storeMediaCacheBucket = []byte("media_cache")
+var storeAutoDownloadBucket = []byte("auto_download")
+
+type storedQueueEntry struct {
+	ID      uint64 `json:"id"`
+	URL     string `json:"url"`
+	Format  string `json:"format"`
+	Quality string `json:"quality"`
+
+	PlaylistStart int `json:"playlist_start"`
+	PlaylistEnd   int `json:"playlist_end"`
+	PlaylistIndex int `json:"playlist_index"`
+
+	ClipStart float64 `json:"clip_start"`
+	ClipEnd   float64 `json:"clip_end"`
+
+	SubLangs []string `json:"sub_langs"`
+	SubMode  string   `json:"sub_mode"`
+
+	UserID            int64  `json:"user_id"`
+	UserAccessHash    int64  `json:"user_access_hash"`
+	ChatID            int64  `json:"chat_id"`
+	ChannelID         int64  `json:"channel_id"`
+	ChannelAccessHash int64  `json:"channel_access_hash"`
+	FromUsername      string `json:"from_username"`
+
+	OrigMsgID  int       `json:"orig_msg_id"`
+	TopicID    int       `json:"topic_id"`
+	Repost     bool      `json:"repost"`
+	ReplyMsgID int       `json:"reply_msg_id"`
+	AddedAt    time.Time `json:"added_at"`
+}
+
+type Store struct {
+	db *bolt.DB
+}
+
+var store Store
+
+func storeKey(id uint64) []byte {
+	// Big endian keys keep the entries sorted by ID, which is the order they were added.
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func (s *Store) Init(path string) (err error) {
+	s.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: storeOpenTimeout})
+	if err != nil {
+		return fmt.Errorf("opening db %s: %w", path, err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{storeQueueBucket, storeCaptionsBucket, storeMediaCacheBucket, storeAutoDownloadBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return fmt.Errorf("creating db bucket: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// NextQueueEntryID returns a new, unique queue entry ID.
+func (s *Store) NextQueueEntryID() (id uint64, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		id, err = tx.Bucket(storeQueueBucket).NextSequence()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("getting next queue entry id: %w", err)
+	}
+	return id, nil
+}
+
+// PutQueueEntry stores the given entry, overwriting the already stored entry with the same ID.
+func (s *Store) PutQueueEntry(e storedQueueEntry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding queue entry: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeQueueBucket).Put(storeKey(e.ID), v)
+	})
+}
+
+func (s *Store) DeleteQueueEntry(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeQueueBucket).Delete(storeKey(id))
+	})
+}
+
+// GetQueueEntries returns the stored entries in the order they were added.
+func (s *Store) GetQueueEntries() (entries []storedQueueEntry, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeQueueBucket).ForEach(func(k, v []byte) error {
+			var e storedQueueEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				fmt.Println("  can't decode stored queue entry:", err)
+				return nil
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return
+}
+
+// GetCaptionTemplate returns the caption template of the given chat. Found is false if the chat has no template set.
+func (s *Store) GetCaptionTemplate(chatID int64) (tmpl string, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(storeCaptionsBucket).Get(storeKey(uint64(chatID)))
+		if v != nil {
+			tmpl = string(v)
+			found = true
+		}
+		return nil
+	})
+	return
+}
+
+// PutCaptionTemplate sets the caption template of the given chat. An empty template disables captions.
+func (s *Store) PutCaptionTemplate(chatID int64, tmpl string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeCaptionsBucket).Put(storeKey(uint64(chatID)), []byte(tmpl))
+	})
+}
+
+func (s *Store) DeleteCaptionTemplate(chatID int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeCaptionsBucket).Delete(storeKey(uint64(chatID)))
+	})
+}
+
+// GetCachedDocuments returns the cached documents of the given media cache key. Found is false if the media is
+// not cached.
+func (s *Store) GetCachedDocuments(key string) (docs []cachedDocument, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(storeMediaCacheBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &docs); err != nil {
+			return fmt.Errorf("decoding cached documents: %w", err)
+		}
+		found = len(docs) > 0
+		return nil
+	})
+	return
+}
+
+func (s *Store) PutCachedDocuments(key string, docs []cachedDocument) error {
+	v, err := json.Marshal(docs)
+	if err != nil {
+		return fmt.Errorf("encoding cached documents: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeMediaCacheBucket).Put([]byte(key), v)
+	})
+}
+
+func (s *Store) DeleteCachedDocuments(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeMediaCacheBucket).Delete([]byte(key))
+	})
+}
+
+// GetAutoDownloadSettings returns the automatic URL detection settings of the given chat. Found is false if the
+// chat has no settings stored.
+func (s *Store) GetAutoDownloadSettings(chatID int64) (settings autoDownloadSettings, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(storeAutoDownloadBucket).Get(storeKey(uint64(chatID)))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &settings); err != nil {
+			return fmt.Errorf("decoding auto download settings: %w", err)
+		}
+		found = true
+		return nil
+	})
+	return
+}
+
+func (s *Store) PutAutoDownloadSettings(chatID int64, settings autoDownloadSettings) error {
+	v, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("encoding auto download settings: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeAutoDownloadBucket).Put(storeKey(uint64(chatID)), v)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+	"github.com/wader/goutubedl"
+	"golang.org/x/exp/slices"
+)
+
+const subtitleDownloadTimeout = 30 * time.Second
+const maxSubtitleBytes = 10 * 1024 * 1024
+
+// Subtitles are embedded as soft subtitle tracks.
+const subtitleModeEmbed = "subs"
+
+// Subtitles are burned into the picture.
+const subtitleModeBurn = "burnsubs"
+
+// Subtitles are sent as separate .srt documents.
+const subtitleModeSRT = "srtsubs"
+
+// Subtitle formats which can be converted by ffmpeg, in the order of preference.
+var subtitleExts = []string{"srt", "vtt", "ass", "ttml"}
+
+// SubtitleFile is a downloaded subtitle, converted to SRT.
+type SubtitleFile struct {
+	Lang string
+	Path string
+}
+
+// Parses subtitle args like "subs:en,de". Ok is false if the given arg is not a subtitle arg.
+func parseSubtitlesArg(arg string) (mode string, langs []string, ok bool, err error) {
+	mode, langsStr, found := strings.Cut(arg, ":")
+	if !found || !slices.Contains([]string{subtitleModeEmbed, subtitleModeBurn, subtitleModeSRT}, mode) {
+		return "", nil, false, nil
+	}
+	for _, l := range strings.Split(langsStr, ",") {
+		if l = strings.TrimSpace(l); l != "" && !slices.Contains(langs, l) {
+			langs = append(langs, l)
+		}
+	}
+	if len(langs) == 0 {
+		return "", nil, true, fmt.Errorf("no subtitle languages given, use like %s:en", mode)
+	}
+	if mode == subtitleModeBurn && len(langs) > 1 {
+		return "", nil, true, fmt.Errorf("only one subtitle language can be burned in")
+	}
+	return mode, langs, true, nil
+}
+
+// Adds the automatic captions from the given raw yt-dlp info to the info's subtitles for the languages which have
+// no subtitles, as goutubedl doesn't parse them.
+func addAutomaticCaptions(info *goutubedl.Info, rawJSON []byte) {
+	var raw struct {
+		AutomaticCaptions map[string][]goutubedl.Subtitle `json:"automatic_captions"`
+	}
+	if err := json.Unmarshal(rawJSON, &raw); err != nil {
+		fmt.Println("  error decoding automatic captions:", err)
+		return
+	}
+
+	subtitles := make(map[string][]goutubedl.Subtitle)
+	for lang, subs := range raw.AutomaticCaptions {
+		for i := range subs {
+			subs[i].Language = lang
+		}
+		subtitles[lang] = subs
+	}
+	// Subtitles made by humans are preferred.
+	for lang, subs := range info.Subtitles {
+		subtitles[lang] = subs
+	}
+	info.Subtitles = subtitles
+}
+
+// Returns the subtitle of the given language in the most preferred format. Regional variants are used if there's
+// no exact match, so "en" matches "en-US".
+func findSubtitle(info goutubedl.Info, lang string) *goutubedl.Subtitle {
+	subs, ok := info.Subtitles[lang]
+	if !ok {
+		for l, s := range info.Subtitles {
+			if strings.HasPrefix(l, lang+"-") {
+				subs = s
+				break
+			}
+		}
+	}
+	for _, ext := range subtitleExts {
+		for i := range subs {
+			if subs[i].Ext == ext {
+				return &subs[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Downloads the subtitles of the requested languages to a temp dir, and converts them to SRT. If a clip is
+// requested, then only the subtitles of the clip are kept. Missing languages are skipped. The returned temp dir
+// should be removed by the caller.
+func (d *Downloader) downloadSubtitles(ctx context.Context, info goutubedl.Info) (dir string, files []SubtitleFile, err error) {
+	dir, err = os.MkdirTemp("", "yt-dlp-telegram-bot-subs-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+
+	for _, lang := range d.SubtitleLangs {
+		sub := findSubtitle(info, lang)
+		if sub == nil {
+			fmt.Println("  no subtitles found for language", lang)
+			continue
+		}
+
+		b, err := httpGet(ctx, sub.URL, subtitleDownloadTimeout, maxSubtitleBytes)
+		if err != nil {
+			fmt.Println("  error downloading", lang, "subtitles:", err)
+			continue
+		}
+		srcPath := path.Join(dir, lang+"-src."+sub.Ext)
+		if err := os.WriteFile(srcPath, b, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("writing subtitles: %w", err)
+		}
+
+		inputArgs := ffmpeg_go.KwArgs{}
+		if d.ClipEnd > 0 {
+			inputArgs = ffmpeg_go.KwArgs{"ss": fmt.Sprint(d.ClipStart), "t": fmt.Sprint(d.ClipEnd - d.ClipStart)}
+		}
+		srtPath := path.Join(dir, lang+".srt")
+		ffCmd := ffmpeg_go.Input(srcPath, inputArgs).Output(srtPath, ffmpeg_go.KwArgs{"format": "srt"}).OverWriteOutput().Compile()
+		if err := NewCommand(ctx, ffCmd.Args[0], ffCmd.Args[1:]...).Run(); err != nil {
+			fmt.Println("  error converting", lang, "subtitles:", err)
+			continue
+		}
+		files = append(files, SubtitleFile{Lang: lang, Path: srtPath})
+	}
+
+	if len(files) == 0 {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("no subtitles found for %s", strings.Join(d.SubtitleLangs, ", "))
+	}
+	return dir, files, nil
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"math/big"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/flytam/filenamify"
@@ -14,54 +16,430 @@ import (
 	"github.com/gotd/td/tg"
 )
 
-type Uploader struct{}
+const maxAlbumSize = 10
 
-var dlUploader Uploader
+// Collects the uploaded media of playlist items, and sends them as an album when all items are finished.
+type playlistAlbum struct {
+	mutex        sync.Mutex
+	peer         tg.InputPeerClass
+	replyToMsgID int
+	pending      int
+	media        []message.MultiMediaOption
+}
+
+// Adds the uploaded media of a finished playlist item. Media is nil if the item failed or got canceled.
+func (a *playlistAlbum) addItem(ctx context.Context, media message.MultiMediaOption) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if media != nil {
+		a.media = append(a.media, media)
+	}
+	a.pending--
+	if a.pending > 0 || len(a.media) == 0 {
+		return
+	}
+
+	fmt.Println("  sending album of", len(a.media), "items")
+	if _, err := telegramSender.To(a.peer).Reply(a.replyToMsgID).Album(ctx, a.media[0], a.media[1:]...); err != nil {
+		fmt.Println("  error sending album:", err)
+	}
+}
+
+type Uploader struct {
+	qEntry *DownloadQueueEntry
+
+	// The sent documents, which get stored in the media cache.
+	cachedDocs []cachedDocument
+}
 
 func (p Uploader) Chunk(ctx context.Context, state uploader.ProgressState) error {
-	dlQueue.HandleProgressPercentUpdate(uploadStr, int(state.Uploaded*100/state.Total))
+	dlQueue.HandleProgressPercentUpdate(p.qEntry, uploadStr, int(state.Uploaded*100/state.Total))
 	return nil
 }
 
-func (p *Uploader) UploadFile(ctx context.Context, entities tg.Entities, u *tg.UpdateNewMessage, f io.ReadCloser, format, title string) error {
-	// Reading to a buffer first, because we don't know the file size.
-	var buf bytes.Buffer
-	for {
-		b := make([]byte, 1024)
-		n, err := f.Read(b)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("reading to buffer error: %w", err)
+// Telegram's max. file size for bot uploads.
+const telegramMaxUploadSize = 2000 * 1024 * 1024
+
+const oversizeModeSplit = "split"
+const oversizeModeCompress = "compress"
+const oversizeModeError = "error"
+
+const repostModeReply = "reply"
+const repostModeReplace = "replace"
+
+// Deletes the original post of the given repost entry in replace repost mode, as the media has been posted in
+// its place.
+func deleteRepostedPost(ctx context.Context, qEntry *DownloadQueueEntry) {
+	if !qEntry.Repost || params.RepostMode != repostModeReplace {
+		return
+	}
+	peer, ok := qEntry.Peer.(*tg.InputPeerChannel)
+	if !ok {
+		return
+	}
+	_, err := telegramAPI.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{
+		Channel: &tg.InputChannel{ChannelID: peer.ChannelID, AccessHash: peer.AccessHash},
+		ID:      []int{qEntry.OrigMsgID},
+	})
+	if err != nil {
+		fmt.Println("  error deleting reposted post:", err)
+	}
+}
+
+// Returns the max. size of an uploaded file, which is the lower of params.MaxSize and Telegram's limit.
+func getMaxUploadSize() int64 {
+	if params.MaxSize > 0 && params.MaxSize < telegramMaxUploadSize {
+		return params.MaxSize
+	}
+	return telegramMaxUploadSize
+}
+
+// Limits the amount of data which can be written to the underlying writer to maxSize. No limit is used if
+// maxSize is 0.
+type maxSizeWriter struct {
+	w       io.Writer
+	maxSize int64
+	written int64
+}
+
+func (w *maxSizeWriter) Write(b []byte) (int, error) {
+	if w.maxSize > 0 && w.written+int64(len(b)) > w.maxSize {
+		return 0, fmt.Errorf("file is too big, max. allowed size is %s", humanize.BigBytes(big.NewInt(w.maxSize)))
+	}
+	n, err := w.w.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Writes the given reader's data to a temp file, so the file size will be known for the upload without holding
+// the whole file in memory. The temp file should be removed by the caller.
+func (p *Uploader) spoolToTempFile(f io.Reader, maxSize int64) (tmpFile *os.File, size int64, err error) {
+	tmpFile, err = os.CreateTemp("", "yt-dlp-telegram-bot-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating temp file: %w", err)
+	}
+
+	w := &maxSizeWriter{w: tmpFile, maxSize: maxSize}
+	if _, err = io.Copy(w, f); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, fmt.Errorf("writing temp file: %w", err)
+	}
+
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, fmt.Errorf("seeking temp file: %w", err)
+	}
+	return tmpFile, w.written, nil
+}
+
+// Uploads a thumbnail generated from the given video file. Returns nil if the thumbnail can't be generated, as
+// the video can be sent without it.
+func (p *Uploader) uploadThumbnail(ctx context.Context, conv *Converter, filePath string, duration float64) tg.InputFileClass {
+	thumb, err := conv.GenerateThumbnail(ctx, filePath, duration)
+	if err != nil {
+		fmt.Println("  " + err.Error())
+		return nil
+	}
+	// Not reporting the progress of the thumbnail upload as it's small.
+	file, err := uploader.NewUploader(telegramAPI).FromBytes(ctx, "thumb.jpg", thumb)
+	if err != nil {
+		fmt.Println("  error uploading thumbnail:", err)
+		return nil
+	}
+	return file
+}
+
+// Uploads the given file, and returns it as a document ready to be sent, with the attributes of the media and
+// the caption of the chat. The returned cached document has the info of the media, the document fields get set
+// after the document is sent.
+func (p *Uploader) uploadDocument(ctx context.Context, res *DownloadResult, f *os.File, size int64, title string, duration float64) (message.MultiMediaOption, cachedDocument, error) {
+	width, height := res.Conv.GetDisplaySize()
+	cDoc := cachedDocument{
+		Title:    title,
+		Uploader: res.Uploader,
+		Duration: duration,
+		Width:    width,
+		Height:   height,
+		Size:     size,
+	}
+
+	// Using a separate uploader for each upload, so progress is reported to the right queue entry.
+	upload, err := uploader.NewUploader(telegramAPI).WithProgress(p).Upload(ctx, uploader.NewUpload("yt-dlp", f, size))
+	if err != nil {
+		return nil, cDoc, fmt.Errorf("uploading %w", err)
+	}
+
+	// The caption is rendered for the first requester, the others get the document with their own caption.
+	captionEntry := p.qEntry
+	if entries := p.qEntry.getDeliveryEntries(); len(entries) > 0 {
+		captionEntry = entries[0]
+	}
+	var caption []message.StyledTextOption
+	if res.Conv.Format == videoNoteFormat {
+		// Video notes can't have captions.
+		cDoc.Round = true
+	} else {
+		chatID := getChatID(captionEntry.FromUser, captionEntry.FromGroup)
+		caption, err = renderCaption(getCaptionTemplate(chatID), newCaptionData(captionEntry, cDoc))
+		if err != nil {
+			// The media is still sent, just without a caption.
+			fmt.Println("  error rendering caption:", err)
 		}
-		if n == 0 {
-			break
+	}
+
+	filename, _ := filenamify.Filenamify(title+"."+res.OutputFormat, filenamify.Options{Replacement: " "})
+	document := message.UploadedDocument(upload, caption...).Filename(filename)
+	durationTime := time.Duration(duration * float64(time.Second))
+	if res.Conv.Format == voiceFormat {
+		voice := document.MIME(audioFormats[voiceFormat].MIME).Voice().Duration(durationTime)
+		waveform, err := res.Conv.GenerateWaveform(ctx, f.Name(), duration)
+		if err != nil {
+			// The voice message is still sent, just without a waveform.
+			fmt.Println("  " + err.Error())
+		} else {
+			voice = voice.Waveform(waveform)
 		}
-		if params.MaxSize > 0 && buf.Len() > int(params.MaxSize) {
-			return fmt.Errorf("file is too big, max. allowed size is %s", humanize.BigBytes(big.NewInt(int64(params.MaxSize))))
+		return voice, cDoc, nil
+	}
+	if res.Conv.Format == gifFileFormat {
+		// Telegram would convert the .gif to an MP4 animation if it's not sent as a file.
+		return document.MIME("image/gif").ForceFile(true), cDoc, nil
+	}
+	if af, ok := audioFormats[res.Conv.Format]; ok {
+		return document.MIME(af.MIME).Audio().Title(title).Performer(res.Conv.Metadata.Artist).Duration(durationTime), cDoc, nil
+	}
+
+	if thumb := p.uploadThumbnail(ctx, res.Conv, f.Name(), duration); thumb != nil {
+		document = document.Thumb(thumb)
+	}
+	switch res.Conv.Format {
+	case videoNoteFormat:
+		return document.RoundVideo().Duration(durationTime).Resolution(width, height), cDoc, nil
+	case gifFormat:
+		document = document.MIME("video/mp4").Attributes(&tg.DocumentAttributeAnimated{})
+		return document.Video().Duration(durationTime).Resolution(width, height), cDoc, nil
+	}
+	return document.Video().Duration(durationTime).Resolution(width, height).SupportsStreaming(), cDoc, nil
+}
+
+// Sends the given document to the first requester, and collects it for the media cache and for the other
+// requesters.
+func (p *Uploader) sendDocument(ctx context.Context, document message.MultiMediaOption, cDoc cachedDocument) error {
+	entries := p.qEntry.getDeliveryEntries()
+	if len(entries) == 0 {
+		fmt.Println("  no requesters left, not sending")
+		return nil
+	}
+	b := telegramSender.To(entries[0].Peer).CloneBuilder()
+	switch {
+	case entries[0].Repost && params.RepostMode == repostModeReply:
+		b = b.Reply(entries[0].OrigMsgID)
+	case entries[0].TopicID != 0:
+		// Replying to the topic's first message puts the message in the topic.
+		b = b.Reply(entries[0].TopicID)
+	}
+	upd, err := b.Media(ctx, document)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+
+	doc, msgID := getSentDocument(upd)
+	if doc == nil {
+		fmt.Println("  can't get sent document, not caching")
+		return nil
+	}
+	cDoc.ID = doc.ID
+	cDoc.AccessHash = doc.AccessHash
+	cDoc.FileReference = doc.FileReference
+	cDoc.MsgID = msgID
+	if peer, ok := entries[0].Peer.(*tg.InputPeerChannel); ok {
+		cDoc.ChannelID = peer.ChannelID
+		cDoc.ChannelAccessHash = peer.AccessHash
+	}
+	p.cachedDocs = append(p.cachedDocs, cDoc)
+	return nil
+}
+
+// Uploads the downloaded subtitles as .srt documents if the requester asked for them. Returns the number of
+// subtitles which should have been sent, failed uploads are skipped, as the media has already been sent.
+func (p *Uploader) uploadSubtitles(ctx context.Context, res *DownloadResult) (count int) {
+	if p.qEntry.SubMode != subtitleModeSRT || p.qEntry.album != nil {
+		return 0
+	}
+	for _, sub := range res.Subtitles {
+		fmt.Println("  uploading", sub.Lang, "subtitles...")
+		b, err := os.ReadFile(sub.Path)
+		if err != nil {
+			fmt.Println("  error reading subtitles:", err)
+			continue
+		}
+		filename, _ := filenamify.Filenamify(res.Title+"."+sub.Lang+".srt", filenamify.Options{Replacement: " "})
+		upload, err := uploader.NewUploader(telegramAPI).FromBytes(ctx, filename, b)
+		if err != nil {
+			fmt.Println("  error uploading subtitles:", err)
+			continue
+		}
+		document := message.UploadedDocument(upload).Filename(filename).MIME("application/x-subrip")
+		if err := p.sendDocument(ctx, document, cachedDocument{Title: res.Title, Subtitle: true}); err != nil {
+			fmt.Println("  error sending subtitles:", err)
+		}
+	}
+	return len(res.Subtitles)
+}
+
+// Stores the sent documents in the media cache if all of them could be collected, and sends the collected
+// documents to the requesters which are attached to the entry.
+func (p *Uploader) storeCachedDocuments(ctx context.Context, sentCount int) {
+	if p.qEntry.album != nil {
+		return
+	}
+	if len(p.cachedDocs) == sentCount {
+		if err := store.PutCachedDocuments(getMediaCacheKey(p.qEntry), p.cachedDocs); err != nil {
+			fmt.Println("  error storing cached documents:", err)
 		}
-		buf.Write(b[:n])
 	}
 
-	fmt.Println("  got", buf.Len(), "bytes, uploading...")
-	dlQueue.currentlyDownloadedEntry.progressInfo = fmt.Sprint(" (", humanize.BigBytes(big.NewInt(int64(buf.Len()))), ")")
+	// New requests for the same media can't be attached after this point.
+	dlQueue.mutex.Lock()
+	p.qEntry.sent = true
+	dlQueue.mutex.Unlock()
 
-	upload, err := telegramUploader.FromBytes(ctx, "yt-dlp", buf.Bytes())
+	entries := p.qEntry.getDeliveryEntries()
+	if len(entries) < 2 {
+		return
+	}
+	fmt.Println("  sending to", len(entries)-1, "attached requesters")
+	for _, e := range entries[1:] {
+		// Skipping the requesters who canceled since the entries were collected.
+		dlQueue.mutex.Lock()
+		attached := e.attachedTo == p.qEntry && !e.Canceled
+		dlQueue.mutex.Unlock()
+		if !attached {
+			continue
+		}
+
+		var err error
+		for i := range p.cachedDocs {
+			if err = sendCachedDocument(ctx, e, &p.cachedDocs[i]); err != nil {
+				break
+			}
+		}
+		if err == nil && len(p.cachedDocs) < sentCount {
+			err = fmt.Errorf("only %d of %d files could be forwarded, please request it again", len(p.cachedDocs), sentCount)
+		}
+		if err != nil {
+			fmt.Println("  error sending to attached requester:", err)
+			dlQueue.failAttachedEntry(ctx, e, err)
+		}
+	}
+}
+
+// Deletes the original posts of the reposted entries which got the media.
+func (p *Uploader) finishReposts(ctx context.Context) {
+	for _, e := range p.qEntry.getDeliveryEntries() {
+		deleteRepostedPost(ctx, e)
+	}
+}
+
+func (p *Uploader) UploadFile(ctx context.Context, res *DownloadResult) error {
+	maxUploadSize := getMaxUploadSize()
+	spoolMaxSize := maxUploadSize
+	if params.OversizeMode == oversizeModeSplit {
+		// The file will be split after it's written, so it can be bigger.
+		spoolMaxSize = 0
+	}
+
+	tmpFile, size, err := p.spoolToTempFile(res.Reader, spoolMaxSize)
 	if err != nil {
-		return fmt.Errorf("uploading %w", err)
+		return err
 	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
 
-	// Now we have uploaded file handle, sending it as styled message. First, preparing message.
-	var document message.MediaOption
-	filename, _ := filenamify.Filenamify(title+"."+format, filenamify.Options{Replacement: " "})
-	if format == "mp3" {
-		document = message.UploadedDocument(upload).Filename(filename).Audio().Title(title)
-	} else {
-		document = message.UploadedDocument(upload).Filename(filename).Video()
+	if size > maxUploadSize {
+		if res.Conv.Format == gifFileFormat {
+			return fmt.Errorf("gif file is too big (%s), try a shorter clip", humanize.BigBytes(big.NewInt(size)))
+		}
+		return p.uploadSplitFile(ctx, res, tmpFile.Name(), size, maxUploadSize)
+	}
+
+	fmt.Println("  got", size, "bytes, uploading...")
+	p.qEntry.progress.progressInfo = fmt.Sprint(" (", humanize.BigBytes(big.NewInt(size)), ")")
+
+	dlQueue.setEntryStage(p.qEntry, stageUploadingStr)
+
+	document, cDoc, err := p.uploadDocument(ctx, res, tmpFile, size, res.Title, res.Conv.Duration)
+	if err != nil {
+		return err
+	}
+
+	// Playlist items are sent as albums when all items of the album are ready, if the format can be in an album.
+	if p.qEntry.album != nil && isAlbumFormat(res.Conv.Format) {
+		p.qEntry.albumMedia = document
+		return nil
 	}
 
 	// Sending message with media.
-	if _, err := telegramSender.Answer(entities, u).Media(ctx, document); err != nil {
-		return fmt.Errorf("send: %w", err)
+	if err := p.sendDocument(ctx, document, cDoc); err != nil {
+		return err
+	}
+	p.storeCachedDocuments(ctx, 1+p.uploadSubtitles(ctx, res))
+	p.finishReposts(ctx)
+	return nil
+}
+
+// Splits the given file to parts which fit the max. upload size, and uploads the parts one by one.
+func (p *Uploader) uploadSplitFile(ctx context.Context, res *DownloadResult, filePath string, size, maxUploadSize int64) error {
+	fmt.Println("  got", size, "bytes, splitting...")
+	p.qEntry.progress.progressInfo = fmt.Sprint(" (splitting ", humanize.BigBytes(big.NewInt(size)), ")")
+
+	// Uploading the parts is not limited by the convert timeout, only the splitting.
+	splitCtx, splitCtxCancel := context.WithTimeout(ctx, params.ConvertTimeout)
+	dir, parts, err := res.Conv.Split(splitCtx, filePath, size, maxUploadSize, res.OutputFormat)
+	splitCtxCancel()
+	if err != nil {
+		return err
 	}
+	defer os.RemoveAll(dir)
 
+	dlQueue.setEntryStage(p.qEntry, stageUploadingStr)
+
+	for i, partPath := range parts {
+		partStr := fmt.Sprint("part ", i+1, "/", len(parts))
+		if err := p.uploadPart(ctx, res, partPath, partStr, res.Title+" ("+partStr+")"); err != nil {
+			return fmt.Errorf("part %d/%d: %w", i+1, len(parts), err)
+		}
+	}
+	p.storeCachedDocuments(ctx, len(parts)+p.uploadSubtitles(ctx, res))
+	p.finishReposts(ctx)
 	return nil
 }
+
+func (p *Uploader) uploadPart(ctx context.Context, res *DownloadResult, partPath, partStr, title string) error {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return fmt.Errorf("opening part: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("checking part size: %w", err)
+	}
+
+	fmt.Println("  uploading", partStr, "with", fi.Size(), "bytes...")
+	p.qEntry.progress.progressInfo = fmt.Sprint(" (", partStr, ", ", humanize.BigBytes(big.NewInt(fi.Size())), ")")
+
+	document, cDoc, err := p.uploadDocument(ctx, res, f, fi.Size(), title, getFileDuration(partPath))
+	if err != nil {
+		return err
+	}
+
+	// Parts are sent right away, even for playlist items, as they can't fit in an album.
+	return p.sendDocument(ctx, document, cDoc)
+}